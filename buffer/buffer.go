@@ -25,8 +25,15 @@ type Event struct {
 
 // subscriber is some host that wants to receive events
 type subscriber struct {
-	Name string
-	Send chan *Event
+	Name   string
+	Send   chan *Event
+	Filter func(*Event) bool
+}
+
+// filteredSender subscribes to a buffer with a filter
+type filteredSender struct {
+	buffer *Buffer
+	filter func(*Event) bool
 }
 
 type Buffer struct {
@@ -50,10 +57,25 @@ func New() *Buffer {
 }
 
 func (b *Buffer) AddSubscriber(name string, ch chan *Event) error {
-	b.add <- &subscriber{name, ch}
+	b.add <- &subscriber{name, ch, nil}
+	return nil
+}
+
+// Filter returns a sender whose subscribers only receive the events the
+// filter accepts
+func (b *Buffer) Filter(filter func(*Event) bool) Sender {
+	return &filteredSender{b, filter}
+}
+
+func (f *filteredSender) AddSubscriber(name string, ch chan *Event) error {
+	f.buffer.add <- &subscriber{name, ch, f.filter}
 	return nil
 }
 
+func (f *filteredSender) DelSubscriber(name string) error {
+	return f.buffer.DelSubscriber(name)
+}
+
 func (b *Buffer) DelSubscriber(name string) error {
 	b.del <- name
 	return nil
@@ -61,6 +83,9 @@ func (b *Buffer) DelSubscriber(name string) error {
 
 func (b *Buffer) Publish(event *Event) {
 	for _, sub := range b.subscribers {
+		if sub.Filter != nil && !sub.Filter(event) {
+			continue
+		}
 		select {
 		case sub.Send <- event:
 		}
@@ -0,0 +1,63 @@
+package buffer
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Matches field references such as %{log_type} in output templates
+var fieldReference = regexp.MustCompile(`%\{([^}]+)\}`)
+
+// FieldString returns the value of an event field as a string
+func (e *Event) FieldString(key string) (string, bool) {
+	if e.Fields == nil {
+		return "", false
+	}
+
+	value, ok := (*e.Fields)[key]
+	if !ok || value == nil {
+		return "", false
+	}
+
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+
+	return fmt.Sprint(value), true
+}
+
+// HasFieldReferences reports whether a template refers to event fields
+func HasFieldReferences(template string) bool {
+	return fieldReference.MatchString(template)
+}
+
+// ExpandFields replaces every %{field} reference in the template with the
+// value of that field in the event. References for which lookup returns
+// false are reported as an error naming the first missing field.
+func ExpandFields(template string, lookup func(string) (string, bool)) (string, error) {
+	var missing string
+
+	result := fieldReference.ReplaceAllStringFunc(template, func(ref string) string {
+		key := strings.TrimSpace(ref[2 : len(ref)-1])
+		value, ok := lookup(key)
+		if !ok && len(missing) == 0 {
+			missing = key
+		}
+		return value
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing field %s", missing)
+	}
+
+	return result, nil
+}
+
+// Expand resolves the field references of a template from the event fields
+func (e *Event) Expand(template string) (string, error) {
+	return ExpandFields(template, e.FieldString)
+}
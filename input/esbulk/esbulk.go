@@ -0,0 +1,141 @@
+package esbulk
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/packetzoom/logzoom/input"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	maxBodyLen         = 100 * 1024 * 1024 // 100 mb, as http.max_content_length
+	defaultReadTimeout = 60
+	defaultVersion     = "7.10.2"
+)
+
+type Config struct {
+	Host        string   `yaml:"host"`
+	Username    string   `yaml:"username"`
+	Password    string   `yaml:"password"`
+	APIKeys     []string `yaml:"api_keys"`
+	SSLCrt      string   `yaml:"ssl_crt"`
+	SSLKey      string   `yaml:"ssl_key"`
+	ReadTimeout int      `yaml:"read_timeout"`
+	Version     string   `yaml:"version"`
+	SampleSize  *int     `yaml:"sample_size,omitempty"`
+}
+
+type BulkServer struct {
+	name     string
+	config   Config
+	receiver input.Receiver
+	server   *http.Server
+	term     chan bool
+}
+
+func init() {
+	input.Register("es_bulk", New)
+}
+
+func New() input.Input {
+	return &BulkServer{term: make(chan bool, 1)}
+}
+
+func (s *BulkServer) ValidateConfig(config *Config) error {
+	if len(config.Host) == 0 {
+		return errors.New("Missing host")
+	}
+
+	if (len(config.SSLCrt) > 0) != (len(config.SSLKey) > 0) {
+		return errors.New("Both ssl_crt and ssl_key are required for TLS")
+	}
+
+	if (len(config.Username) > 0) != (len(config.Password) > 0) {
+		return errors.New("Both username and password are required for basic auth")
+	}
+
+	if len(config.Username) == 0 && len(config.APIKeys) == 0 {
+		log.Printf("[%s] No credentials configured, accepting unauthenticated requests", s.name)
+	}
+
+	if s.config.ReadTimeout <= 0 {
+		s.config.ReadTimeout = defaultReadTimeout
+	}
+
+	if len(s.config.Version) == 0 {
+		s.config.Version = defaultVersion
+	}
+
+	if s.config.SampleSize == nil {
+		i := 100
+		s.config.SampleSize = &i
+	}
+	log.Printf("[%s] Setting Sample Size to %d", s.name, *s.config.SampleSize)
+
+	return nil
+}
+
+func (s *BulkServer) Init(name string, config yaml.MapSlice, receiver input.Receiver) error {
+	var bulkConfig *Config
+
+	// go-yaml doesn't have a great way to partially unmarshal YAML data
+	// See https://github.com/go-yaml/yaml/issues/13
+	yamlConfig, _ := yaml.Marshal(config)
+
+	if err := yaml.Unmarshal(yamlConfig, &bulkConfig); err != nil {
+		return fmt.Errorf("Error parsing es_bulk config: %v", err)
+	}
+
+	s.name = name
+	s.config = *bulkConfig
+	s.receiver = receiver
+
+	if err := s.ValidateConfig(bulkConfig); err != nil {
+		return fmt.Errorf("Error in config: %v", err)
+	}
+
+	return nil
+}
+
+func (s *BulkServer) Start() error {
+	ln, err := net.Listen("tcp", s.config.Host)
+	if err != nil {
+		return fmt.Errorf("Listener failed: %v", err)
+	}
+
+	if len(s.config.SSLCrt) > 0 {
+		cert, err := tls.LoadX509KeyPair(s.config.SSLCrt, s.config.SSLKey)
+		if err != nil {
+			return fmt.Errorf("Error loading keys: %v", err)
+		}
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+
+	s.server = &http.Server{
+		Handler:     s,
+		ReadTimeout: time.Duration(s.config.ReadTimeout) * time.Second,
+	}
+
+	go func() {
+		if err := s.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("[%s] Elasticsearch bulk server error: %v", s.name, err)
+		}
+	}()
+
+	log.Printf("[%s] Started Elasticsearch bulk Instance", s.name)
+
+	<-s.term
+	log.Println("Elasticsearch bulk server received term signal")
+	return s.server.Close()
+}
+
+func (s *BulkServer) Stop() error {
+	s.term <- true
+	return nil
+}
@@ -0,0 +1,372 @@
+package esbulk
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/packetzoom/logzoom/buffer"
+	"github.com/packetzoom/logzoom/server"
+)
+
+// action is the metadata line of a bulk entry, e.g. {"index":{"_index":"logs"}}
+type action struct {
+	Index    string `json:"_index"`
+	ID       string `json:"_id"`
+	Pipeline string `json:"pipeline"`
+}
+
+// target is where the client asked for a document to be written
+type target struct {
+	index    string
+	id       string
+	pipeline string
+}
+
+// result is the outcome of one document, in the form Elasticsearch reports it
+type result struct {
+	Index       string                 `json:"_index"`
+	Type        string                 `json:"_type,omitempty"`
+	ID          string                 `json:"_id"`
+	Version     int                    `json:"_version,omitempty"`
+	Result      string                 `json:"result,omitempty"`
+	Shards      map[string]int         `json:"_shards,omitempty"`
+	SeqNo       int                    `json:"_seq_no"`
+	PrimaryTerm int                    `json:"_primary_term,omitempty"`
+	Status      int                    `json:"status,omitempty"`
+	Error       map[string]interface{} `json:"error,omitempty"`
+}
+
+func created(t target) result {
+	return result{
+		Index:       t.index,
+		Type:        "_doc",
+		ID:          t.id,
+		Version:     1,
+		Result:      "created",
+		Shards:      map[string]int{"total": 1, "successful": 1, "failed": 0},
+		PrimaryTerm: 1,
+		Status:      http.StatusCreated,
+	}
+}
+
+func failed(t target, status int, errType string, reason string) result {
+	return result{
+		Index:  t.index,
+		Type:   "_doc",
+		ID:     t.id,
+		Status: status,
+		Error:  map[string]interface{}{"type": errType, "reason": reason},
+	}
+}
+
+// newID returns a random ID shaped like the ones Elasticsearch generates
+func newID() string {
+	b := make([]byte, 15)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func reply(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	// Elasticsearch 7.14+ clients refuse servers without it
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func replyError(w http.ResponseWriter, status int, errType string, reason string) {
+	reply(w, status, map[string]interface{}{
+		"error": map[string]interface{}{
+			"root_cause": []map[string]string{{"type": errType, "reason": reason}},
+			"type":       errType,
+			"reason":     reason,
+		},
+		"status": status,
+	})
+}
+
+// authorized checks basic auth or an "Authorization: ApiKey <key>" header
+// against the configured credentials
+func (s *BulkServer) authorized(r *http.Request) bool {
+	if len(s.config.Username) == 0 && len(s.config.APIKeys) == 0 {
+		return true
+	}
+
+	if user, password, ok := r.BasicAuth(); ok && len(s.config.Username) > 0 {
+		return subtle.ConstantTimeCompare([]byte(user), []byte(s.config.Username)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(s.config.Password)) == 1
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "ApiKey ") {
+		return false
+	}
+
+	key := strings.TrimSpace(strings.TrimPrefix(auth, "ApiKey "))
+	for _, k := range s.config.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func body(r *http.Request) (io.ReadCloser, error) {
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		return gzip.NewReader(r.Body)
+	}
+	return r.Body, nil
+}
+
+// toEvent builds an event for the buffer from a document. The target index,
+// and the ID and pipeline when given, are added as es_ fields so routes can
+// match on them and outputs can reuse them.
+func toEvent(doc []byte, t target, remote string) (*buffer.Event, error) {
+	var fields map[string]interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&fields); err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		return nil, fmt.Errorf("document is not an object")
+	}
+
+	fields["es_index"] = t.index
+	if len(t.id) > 0 {
+		fields["es_id"] = t.id
+	}
+	if len(t.pipeline) > 0 {
+		fields["es_pipeline"] = t.pipeline
+	}
+
+	text := string(doc)
+	return &buffer.Event{
+		Source: fmt.Sprintf("es_bulk://%s", remote),
+		Text:   &text,
+		Fields: &fields,
+	}, nil
+}
+
+func (s *BulkServer) send(ev *buffer.Event) {
+	if server.RandInt(0, 100) < *s.config.SampleSize {
+		s.receiver.Send(ev)
+	}
+}
+
+// index turns a document into an event and reports the outcome
+func (s *BulkServer) index(doc []byte, t target, remote string) result {
+	if len(t.index) == 0 {
+		return failed(t, http.StatusBadRequest, "action_request_validation_exception", "Validation Failed: 1: index is missing;")
+	}
+
+	ev, err := toEvent(doc, t, remote)
+	if err != nil {
+		return failed(t, http.StatusBadRequest, "mapper_parsing_exception", fmt.Sprintf("failed to parse: %v", err))
+	}
+
+	if len(t.id) == 0 {
+		t.id = newID()
+	}
+
+	s.send(ev)
+	return created(t)
+}
+
+// handleBulk reads the newline-delimited actions and documents of a bulk
+// request. index and create actions are accepted; update and delete have
+// nothing to act on here and are rejected per item.
+func (s *BulkServer) handleBulk(w http.ResponseWriter, r *http.Request, defaults target, remote string) {
+	start := time.Now()
+
+	reader, err := body(r)
+	if err != nil {
+		replyError(w, http.StatusBadRequest, "parse_exception", "request body is not valid gzip")
+		return
+	}
+	defer reader.Close()
+
+	scanner := bufio.NewScanner(io.LimitReader(reader, maxBodyLen))
+	scanner.Buffer(make([]byte, 64*1024), maxBodyLen)
+
+	next := func() ([]byte, bool) {
+		for scanner.Scan() {
+			if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+				return line, true
+			}
+		}
+		return nil, false
+	}
+
+	items := make([]map[string]result, 0)
+	hasErrors := false
+
+	for {
+		line, ok := next()
+		if !ok {
+			break
+		}
+
+		var entry map[string]action
+		if err := json.Unmarshal(line, &entry); err != nil || len(entry) != 1 {
+			replyError(w, http.StatusBadRequest, "illegal_argument_exception", "Malformed action/metadata line ["+string(line)+"]")
+			return
+		}
+
+		for op, meta := range entry {
+			t := target{index: meta.Index, id: meta.ID, pipeline: meta.Pipeline}
+			if len(t.index) == 0 {
+				t.index = defaults.index
+			}
+			if len(t.pipeline) == 0 {
+				t.pipeline = defaults.pipeline
+			}
+
+			var res result
+
+			switch op {
+			case "index", "create":
+				doc, ok := next()
+				if !ok {
+					replyError(w, http.StatusBadRequest, "illegal_argument_exception", "The bulk request must be terminated by a newline [\\n]")
+					return
+				}
+				res = s.index(doc, t, remote)
+			case "update":
+				next()
+				res = failed(t, http.StatusBadRequest, "illegal_argument_exception", "update is not supported")
+			case "delete":
+				res = failed(t, http.StatusBadRequest, "illegal_argument_exception", "delete is not supported")
+			default:
+				replyError(w, http.StatusBadRequest, "illegal_argument_exception", fmt.Sprintf("Unknown action [%s]", op))
+				return
+			}
+
+			if res.Status >= 300 {
+				hasErrors = true
+			}
+			items = append(items, map[string]result{op: res})
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		replyError(w, http.StatusRequestEntityTooLarge, "parse_exception", err.Error())
+		return
+	}
+
+	reply(w, http.StatusOK, map[string]interface{}{
+		"took":   int64(time.Since(start) / time.Millisecond),
+		"errors": hasErrors,
+		"items":  items,
+	})
+}
+
+// handleDocument accepts a single document, as sent to /{index}/_doc
+func (s *BulkServer) handleDocument(w http.ResponseWriter, r *http.Request, t target, remote string) {
+	reader, err := body(r)
+	if err != nil {
+		replyError(w, http.StatusBadRequest, "parse_exception", "request body is not valid gzip")
+		return
+	}
+	defer reader.Close()
+
+	doc, err := ioutil.ReadAll(io.LimitReader(reader, maxBodyLen))
+	if err != nil {
+		replyError(w, http.StatusBadRequest, "parse_exception", err.Error())
+		return
+	}
+
+	res := s.index(bytes.TrimSpace(doc), t, remote)
+	if res.Error != nil {
+		replyError(w, res.Status, res.Error["type"].(string), res.Error["reason"].(string))
+		return
+	}
+
+	res.Status = 0
+	reply(w, http.StatusCreated, res)
+}
+
+// handleInfo answers GET /, which clients call to check the version
+func (s *BulkServer) handleInfo(w http.ResponseWriter) {
+	reply(w, http.StatusOK, map[string]interface{}{
+		"name":         s.name,
+		"cluster_name": "logzoom",
+		"version": map[string]interface{}{
+			"number":       s.config.Version,
+			"build_flavor": "default",
+		},
+		"tagline": "You Know, for Search",
+	})
+}
+
+// isTypeName reports whether a path segment is a document type rather than
+// an API endpoint such as _search or _update
+func isTypeName(segment string) bool {
+	return !strings.HasPrefix(segment, "_")
+}
+
+func (s *BulkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="security" charset="UTF-8"`)
+		replyError(w, http.StatusUnauthorized, "security_exception", "unable to authenticate request")
+		return
+	}
+
+	remote, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	var parts []string
+	if path := strings.Trim(r.URL.Path, "/"); len(path) > 0 {
+		parts = strings.Split(path, "/")
+	}
+
+	pipeline := r.URL.Query().Get("pipeline")
+
+	if len(parts) == 0 && (r.Method == "GET" || r.Method == "HEAD") {
+		s.handleInfo(w)
+		return
+	}
+
+	if r.Method == "POST" || r.Method == "PUT" {
+		switch {
+		// /_bulk, /{index}/_bulk and /{index}/{type}/_bulk
+		case len(parts) >= 1 && len(parts) <= 3 && parts[len(parts)-1] == "_bulk" &&
+			(len(parts) < 3 || isTypeName(parts[1])):
+			t := target{pipeline: pipeline}
+			if len(parts) > 1 {
+				t.index = parts[0]
+			}
+			s.handleBulk(w, r, t, remote)
+			return
+		// /{index}/_doc and the typed /{index}/{type}
+		case len(parts) == 2 && !strings.HasPrefix(parts[0], "_") && r.Method == "POST" &&
+			(parts[1] == "_doc" || isTypeName(parts[1])):
+			s.handleDocument(w, r, target{index: parts[0], pipeline: pipeline}, remote)
+			return
+		// /{index}/_doc/{id}, /{index}/_create/{id} and /{index}/{type}/{id}
+		case len(parts) == 3 && !strings.HasPrefix(parts[0], "_") &&
+			(parts[1] == "_doc" || parts[1] == "_create" || isTypeName(parts[1])):
+			s.handleDocument(w, r, target{index: parts[0], id: parts[2], pipeline: pipeline}, remote)
+			return
+		}
+	}
+
+	log.Printf("[%s] Unsupported Elasticsearch endpoint %s %s from %s", s.name, r.Method, r.URL.Path, remote)
+	replyError(w, http.StatusBadRequest, "illegal_argument_exception",
+		fmt.Sprintf("request [%s] contains unrecognized endpoint", r.URL.Path))
+}
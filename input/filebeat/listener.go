@@ -0,0 +1,65 @@
+package filebeat
+
+import (
+	"net"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+	"golang.org/x/net/netutil"
+)
+
+// idleConn closes the connection if nothing is read from it for the
+// configured timeout
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// idleListener wraps accepted connections in an idleConn
+type idleListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func (l *idleListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &idleConn{Conn: conn, timeout: l.timeout}, nil
+}
+
+func requireProxyHeader(net.Addr) (proxyproto.Policy, error) {
+	return proxyproto.REQUIRE, nil
+}
+
+// listen opens the plain TCP listener and applies the connection limit,
+// PROXY protocol and idle timeout options. TLS is layered on top by the
+// caller.
+func (lj *LJServer) listen() (net.Listener, error) {
+	ln, err := net.Listen("tcp", lj.Config.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	if lj.Config.MaxConnections > 0 {
+		ln = netutil.LimitListener(ln, lj.Config.MaxConnections)
+	}
+
+	if lj.Config.ProxyProtocol {
+		ln = &proxyproto.Listener{Listener: ln, Policy: requireProxyHeader}
+	}
+
+	if lj.Config.IdleTimeout > 0 {
+		ln = &idleListener{Listener: ln, timeout: time.Duration(lj.Config.IdleTimeout) * time.Second}
+	}
+
+	return ln, nil
+}
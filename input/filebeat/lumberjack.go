@@ -2,19 +2,37 @@ package filebeat
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"gopkg.in/yaml.v2"
 	"log"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/packetzoom/logzoom/input"
 )
 
+const (
+	defaultReloadInterval = 60
+)
+
 type Config struct {
-	Host   string `yaml:"host"`
-	SSLCrt string `yaml:"ssl_crt"`
-	SSLKey string `yaml:"ssl_key"`
-	SampleSize *int `yaml:"sample_size,omitempty"`
+	Host              string   `yaml:"host"`
+	SSLCrt            string   `yaml:"ssl_crt"`
+	SSLKey            string   `yaml:"ssl_key"`
+	SSLCA             string   `yaml:"ssl_ca"`
+	SSLVerifyClient   bool     `yaml:"ssl_verify_client"`
+	SSLAllowedCNs     []string `yaml:"ssl_allowed_cns"`
+	SSLAllowedSANs    []string `yaml:"ssl_allowed_sans"`
+	SSLMinVersion     string   `yaml:"ssl_min_version"`
+	SSLCiphers        []string `yaml:"ssl_ciphers"`
+	SSLReloadInterval int      `yaml:"ssl_reload_interval"`
+	TLS               *bool    `yaml:"tls,omitempty"`
+	ProxyProtocol     bool     `yaml:"proxy_protocol"`
+	IdleTimeout       int      `yaml:"idle_timeout"`
+	MaxConnections    int      `yaml:"max_connections"`
+	SampleSize        *int     `yaml:"sample_size,omitempty"`
 }
 
 type LJServer struct {
@@ -22,20 +40,47 @@ type LJServer struct {
 	Config *Config
 	r      input.Receiver
 	term   chan bool
+	done   chan bool
+	stop   sync.Once
 }
 
 func New() input.Input {
-        return &LJServer{term: make(chan bool, 1)}
+        return &LJServer{term: make(chan bool, 1), done: make(chan bool)}
 }
 
 // lumberConn handles an incoming connection from a lumberjack client
-func lumberConn(c net.Conn, r input.Receiver, sampleSize int) {
+func (lj *LJServer) lumberConn(c net.Conn) {
 	defer c.Close()
 	log.Printf("[%s] accepting lumberjack connection", c.RemoteAddr().String())
-	NewParser(c, r, sampleSize).Parse()
+
+	parser := NewParser(c, lj.r, *lj.Config.SampleSize)
+
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		cn, err := lj.clientIdentity(tlsConn)
+		if err != nil {
+			log.Printf("[%s] rejecting lumberjack connection: %v", c.RemoteAddr().String(), err)
+			return
+		}
+		parser.ClientCN = cn
+	}
+
+	parser.Parse()
 	log.Printf("[%s] closing lumberjack connection", c.RemoteAddr().String())
 }
 
+func (lj *LJServer) tlsEnabled() bool {
+	return lj.Config.TLS == nil || *lj.Config.TLS
+}
+
+func (lj *LJServer) ValidateConfig(config *Config) error {
+	// Without a CA bundle there is nothing to verify client certificates against
+	if config.SSLVerifyClient && len(config.SSLCA) == 0 {
+		return errors.New("ssl_verify_client requires ssl_ca")
+	}
+
+	return nil
+}
+
 func (lj *LJServer) Init(name string, config yaml.MapSlice, r input.Receiver) error {
 	var ljConfig *Config
 
@@ -51,29 +96,49 @@ func (lj *LJServer) Init(name string, config yaml.MapSlice, r input.Receiver) er
 	lj.Config = ljConfig
 	lj.r = r
 
+	if err := lj.ValidateConfig(ljConfig); err != nil {
+		return fmt.Errorf("Error in config: %v", err)
+	}
+
 	return nil
 }
 
 func (lj *LJServer) Start() error {
-	cert, err := tls.LoadX509KeyPair(lj.Config.SSLCrt, lj.Config.SSLKey)
-	if err != nil {
-		return fmt.Errorf("Error loading keys: %v", err)
-	}
-
 	if lj.Config.SampleSize == nil {
 		i := 100
 		lj.Config.SampleSize = &i
 	}
 	log.Printf("[%s] Setting Sample Size to %d%%", lj.name, *lj.Config.SampleSize)
 
-	conn, err := net.Listen("tcp", lj.Config.Host)
+	ln, err := lj.listen()
 	if err != nil {
 		return fmt.Errorf("Listener failed: %v", err)
 	}
 
-	config := tls.Config{Certificates: []tls.Certificate{cert}}
+	if lj.tlsEnabled() {
+		store, err := newCertStore(lj.name, lj.Config.SSLCrt, lj.Config.SSLKey, lj.Config.SSLCA)
+		if err != nil {
+			ln.Close()
+			return err
+		}
 
-	ln := tls.NewListener(conn, &config)
+		config, err := lj.tlsConfig(store)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+
+		if lj.Config.SSLReloadInterval == 0 {
+			lj.Config.SSLReloadInterval = defaultReloadInterval
+		}
+		if lj.Config.SSLReloadInterval > 0 {
+			go store.watch(time.Duration(lj.Config.SSLReloadInterval)*time.Second, lj.done)
+		}
+
+		ln = tls.NewListener(ln, config)
+	} else {
+		log.Printf("[%s] TLS is disabled, accepting plaintext connections", lj.name)
+	}
 
 	log.Printf("[%s] Started Lumberjack Instance", lj.name)
 	for {
@@ -87,7 +152,7 @@ func (lj *LJServer) Start() error {
 				log.Printf("Error accepting connection: %v", err)
 				continue
 			}
-			go lumberConn(conn, lj.r, *lj.Config.SampleSize)
+			go lj.lumberConn(conn)
 		}
 	}
 
@@ -95,6 +160,9 @@ func (lj *LJServer) Start() error {
 }
 
 func (lj *LJServer) Stop() error {
-	lj.term <- true
+	lj.stop.Do(func() {
+		close(lj.done)
+		lj.term <- true
+	})
 	return nil
 }
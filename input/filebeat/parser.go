@@ -30,6 +30,7 @@ type Parser struct {
 	wlen, plen uint32
 	buffer     io.Reader
 	SampleSize int
+	ClientCN   string
 }
 
 func NewParser(c net.Conn, r input.Receiver, sampleSize int) *Parser {
@@ -53,6 +54,16 @@ func (p *Parser) ack(seq uint32) error {
 	return nil
 }
 
+// setClientIdentity records the verified client certificate on the event
+// so that routes can match on it. A value sent by the client is discarded.
+func (p *Parser) setClientIdentity(fields map[string]interface{}) {
+	if len(p.ClientCN) > 0 {
+		fields[clientCNField] = p.ClientCN
+	} else {
+		delete(fields, clientCNField)
+	}
+}
+
 // readKV parses key value pairs from within the payload
 func (p *Parser) readKV() ([]byte, []byte, error) {
 	var klen, vlen uint32
@@ -131,6 +142,7 @@ func (p *Parser) read() (uint32, error) {
 				fields[string(k)] = string(v)
 			}
 
+			p.setClientIdentity(fields)
 			ev.Source = fmt.Sprintf("lumberjack://%s%s", fields["host"], fields["file"])
 			ev.Offset, _ = strconv.ParseInt(fields["offset"].(string), 10, 64)
 			ev.Line = uint64(seq)
@@ -164,6 +176,7 @@ func (p *Parser) read() (uint32, error) {
 			if err != nil {
 				return seq, err
 			}
+			p.setClientIdentity(fields)
 			ev.Source = fmt.Sprintf("lumberjack://%s%s", fields["host"], fields["file"])
 			jsonNumber := fields["offset"].(json.Number)
 			ev.Offset, _ = jsonNumber.Int64()
@@ -0,0 +1,271 @@
+package filebeat
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Event field carrying the common name of a verified client certificate
+	clientCNField = "tls_client_cn"
+
+	// Time allowed for a client to complete the TLS handshake
+	handshakeTimeout = 10 * time.Second
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// certStore holds the server certificate and client CA pool and reloads
+// them from disk when the files change, so certificates can be rotated
+// without restarting the input.
+type certStore struct {
+	name     string
+	crtFile  string
+	keyFile  string
+	caFile   string
+	mtx      sync.RWMutex
+	cert     *tls.Certificate
+	caPool   *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+func newCertStore(name, crtFile, keyFile, caFile string) (*certStore, error) {
+	store := &certStore{
+		name:     name,
+		crtFile:  crtFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+		modTimes: make(map[string]time.Time),
+	}
+
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (c *certStore) files() []string {
+	files := []string{c.crtFile, c.keyFile}
+	if len(c.caFile) > 0 {
+		files = append(files, c.caFile)
+	}
+	return files
+}
+
+func (c *certStore) load() error {
+	cert, err := tls.LoadX509KeyPair(c.crtFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("Error loading keys: %v", err)
+	}
+
+	var caPool *x509.CertPool
+	if len(c.caFile) > 0 {
+		pem, err := ioutil.ReadFile(c.caFile)
+		if err != nil {
+			return fmt.Errorf("Error reading CA bundle: %v", err)
+		}
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("No certificates found in CA bundle %s", c.caFile)
+		}
+	}
+
+	modTimes := make(map[string]time.Time)
+	for _, file := range c.files() {
+		if info, err := os.Stat(file); err == nil {
+			modTimes[file] = info.ModTime()
+		}
+	}
+
+	c.mtx.Lock()
+	c.cert = &cert
+	c.caPool = caPool
+	c.modTimes = modTimes
+	c.mtx.Unlock()
+
+	return nil
+}
+
+func (c *certStore) changed() bool {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+
+	for _, file := range c.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(c.modTimes[file]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watch polls the certificate files and reloads them when they change.
+// A failed reload keeps the previous certificates in place.
+func (c *certStore) watch(interval time.Duration, term chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !c.changed() {
+				continue
+			}
+			if err := c.load(); err != nil {
+				log.Printf("[%s] Failed to reload certificates: %v", c.name, err)
+				continue
+			}
+			log.Printf("[%s] Reloaded certificates", c.name)
+		case <-term:
+			return
+		}
+	}
+}
+
+func (c *certStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.cert, nil
+}
+
+func (c *certStore) clientCAs() *x509.CertPool {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	return c.caPool
+}
+
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown or insecure cipher suite %s", name)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// tlsConfig builds the listener configuration. The client CA pool is looked
+// up per handshake so that a reloaded bundle takes effect immediately.
+func (lj *LJServer) tlsConfig(store *certStore) (*tls.Config, error) {
+	base := &tls.Config{GetCertificate: store.getCertificate}
+
+	if len(lj.Config.SSLMinVersion) > 0 {
+		version, ok := tlsVersions[lj.Config.SSLMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("Unknown TLS version %s", lj.Config.SSLMinVersion)
+		}
+		base.MinVersion = version
+	}
+
+	if len(lj.Config.SSLCiphers) > 0 {
+		ciphers, err := parseCipherSuites(lj.Config.SSLCiphers)
+		if err != nil {
+			return nil, err
+		}
+		base.CipherSuites = ciphers
+	}
+
+	if len(lj.Config.SSLCA) == 0 {
+		return base, nil
+	}
+
+	if lj.Config.SSLVerifyClient {
+		base.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		base.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		config := base.Clone()
+		config.GetConfigForClient = nil
+		config.ClientCAs = store.clientCAs()
+		return config, nil
+	}
+
+	return base, nil
+}
+
+// clientIdentity completes the handshake and checks the verified client
+// certificate against the allowed CN and SAN lists. It returns the common
+// name of the client, or an empty string if no certificate was presented.
+func (lj *LJServer) clientIdentity(conn *tls.Conn) (string, error) {
+	// A client stalling the handshake would otherwise hold the connection
+	// and its max_connections slot forever
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return "", err
+	}
+
+	if err := conn.Handshake(); err != nil {
+		return "", fmt.Errorf("TLS handshake failed: %v", err)
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return "", err
+	}
+
+	state := conn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		if len(lj.Config.SSLAllowedCNs) > 0 || len(lj.Config.SSLAllowedSANs) > 0 {
+			return "", errors.New("client did not present a verified certificate")
+		}
+		return "", nil
+	}
+
+	cert := state.VerifiedChains[0][0]
+	cn := cert.Subject.CommonName
+
+	if len(lj.Config.SSLAllowedCNs) == 0 && len(lj.Config.SSLAllowedSANs) == 0 {
+		return cn, nil
+	}
+
+	for _, allowed := range lj.Config.SSLAllowedCNs {
+		if cn == allowed {
+			return cn, nil
+		}
+	}
+
+	sans := append([]string{}, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+
+	for _, allowed := range lj.Config.SSLAllowedSANs {
+		for _, san := range sans {
+			if strings.EqualFold(san, allowed) {
+				return cn, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("client certificate %q is not allowed", cn)
+}
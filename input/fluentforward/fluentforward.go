@@ -0,0 +1,260 @@
+package fluentforward
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"time"
+
+	"github.com/packetzoom/logzoom/buffer"
+	"github.com/packetzoom/logzoom/input"
+	"github.com/packetzoom/logzoom/server"
+	"github.com/vmihailenco/msgpack"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultTagField  = "tag"
+	handshakeTimeout = 10 * time.Second
+)
+
+type Config struct {
+	Host         string `yaml:"host"`
+	SharedKey    string `yaml:"shared_key"`
+	SelfHostname string `yaml:"self_hostname"`
+	TagField     string `yaml:"tag_field"`
+	SampleSize   *int   `yaml:"sample_size,omitempty"`
+}
+
+type ForwardServer struct {
+	name     string
+	config   Config
+	receiver input.Receiver
+	term     chan bool
+}
+
+func init() {
+	input.Register("fluentforward", New)
+}
+
+func New() input.Input {
+	return &ForwardServer{term: make(chan bool, 1)}
+}
+
+// handshake performs the shared key authentication: HELO is sent with a
+// random nonce, the client answers with PING and a digest of the shared
+// key, and the server replies with PONG proving it knows the key too.
+func (f *ForwardServer) handshake(c net.Conn, decoder *msgpack.Decoder, encoder *msgpack.Encoder) error {
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer c.SetDeadline(time.Time{})
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	helo := []interface{}{"HELO", map[string]interface{}{
+		"nonce":     nonce,
+		"auth":      "",
+		"keepalive": true,
+	}}
+	if err := encoder.Encode(helo); err != nil {
+		return err
+	}
+
+	value, err := decoder.DecodeInterface()
+	if err != nil {
+		return err
+	}
+
+	ping, ok := value.([]interface{})
+	if !ok || len(ping) < 4 {
+		return errors.New("invalid PING message")
+	}
+
+	kind, _ := toString(ping[0])
+	hostname, _ := toString(ping[1])
+	salt, _ := toString(ping[2])
+	clientDigest, _ := toString(ping[3])
+
+	if kind != "PING" {
+		return fmt.Errorf("expected PING, got %q", kind)
+	}
+
+	expected := digest(salt, hostname, string(nonce), f.config.SharedKey)
+	if subtle.ConstantTimeCompare([]byte(clientDigest), []byte(expected)) != 1 {
+		encoder.Encode([]interface{}{"PONG", false, "shared_key mismatch", "", ""})
+		return fmt.Errorf("shared key mismatch from %s", hostname)
+	}
+
+	pong := []interface{}{
+		"PONG",
+		true,
+		"",
+		f.config.SelfHostname,
+		digest(salt, f.config.SelfHostname, string(nonce), f.config.SharedKey),
+	}
+
+	return encoder.Encode(pong)
+}
+
+// toEvent maps a forward protocol entry onto an event. The tag is stored
+// in the configured field so routes can match on it, and the record is
+// encoded as JSON for the event text.
+func (f *ForwardServer) toEvent(tag string, e *entry, remote string) (*buffer.Event, error) {
+	fields := e.Record
+	fields[f.config.TagField] = tag
+	if _, ok := fields["timestamp"]; !ok {
+		fields["timestamp"] = e.Time.Format(time.RFC3339Nano)
+	}
+
+	text, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	t := string(text)
+	ev := &buffer.Event{
+		Source: fmt.Sprintf("fluentforward://%s/%s", remote, tag),
+		Text:   &t,
+		Fields: &fields,
+	}
+
+	return ev, nil
+}
+
+// forwardConn handles an incoming connection from a forward client
+func (f *ForwardServer) forwardConn(c net.Conn) {
+	defer c.Close()
+
+	remote := c.RemoteAddr().String()
+	host, _, _ := net.SplitHostPort(remote)
+	log.Printf("[%s] accepting forward connection", remote)
+
+	decoder := msgpack.NewDecoder(bufio.NewReader(c))
+	encoder := msgpack.NewEncoder(c)
+
+	if len(f.config.SharedKey) > 0 {
+		if err := f.handshake(c, decoder, encoder); err != nil {
+			log.Printf("[%s] handshake failed: %v", remote, err)
+			return
+		}
+	}
+
+	for {
+		value, err := decoder.DecodeInterface()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("[%s] error reading %v", remote, err)
+			}
+			break
+		}
+
+		msg, err := toMessage(value)
+		if err != nil {
+			log.Printf("[%s] error parsing %v", remote, err)
+			break
+		}
+
+		for _, e := range msg.Entries {
+			ev, err := f.toEvent(msg.Tag, e, host)
+			if err != nil {
+				log.Printf("[%s] error encoding record: %v", remote, err)
+				continue
+			}
+
+			if server.RandInt(0, 100) < *f.config.SampleSize {
+				f.receiver.Send(ev)
+			}
+		}
+
+		// The chunk is acked only once its events were handed to the buffer
+		if len(msg.Chunk) > 0 {
+			if err := encoder.Encode(map[string]interface{}{"ack": msg.Chunk}); err != nil {
+				log.Printf("[%s] error acking %v", remote, err)
+				break
+			}
+		}
+	}
+
+	log.Printf("[%s] closing forward connection", remote)
+}
+
+func (f *ForwardServer) ValidateConfig(config *Config) error {
+	if len(config.Host) == 0 {
+		return errors.New("Missing host")
+	}
+
+	if len(f.config.TagField) == 0 {
+		f.config.TagField = defaultTagField
+	}
+
+	if len(f.config.SelfHostname) == 0 {
+		f.config.SelfHostname, _ = os.Hostname()
+	}
+
+	if f.config.SampleSize == nil {
+		i := 100
+		f.config.SampleSize = &i
+	}
+	log.Printf("[%s] Setting Sample Size to %d", f.name, *f.config.SampleSize)
+
+	return nil
+}
+
+func (f *ForwardServer) Init(name string, config yaml.MapSlice, receiver input.Receiver) error {
+	var forwardConfig *Config
+
+	// go-yaml doesn't have a great way to partially unmarshal YAML data
+	// See https://github.com/go-yaml/yaml/issues/13
+	yamlConfig, _ := yaml.Marshal(config)
+
+	if err := yaml.Unmarshal(yamlConfig, &forwardConfig); err != nil {
+		return fmt.Errorf("Error parsing fluentforward config: %v", err)
+	}
+
+	f.name = name
+	f.config = *forwardConfig
+	f.receiver = receiver
+
+	if err := f.ValidateConfig(forwardConfig); err != nil {
+		return fmt.Errorf("Error in config: %v", err)
+	}
+
+	return nil
+}
+
+func (f *ForwardServer) Start() error {
+	ln, err := net.Listen("tcp", f.config.Host)
+	if err != nil {
+		return fmt.Errorf("Listener failed: %v", err)
+	}
+
+	log.Printf("[%s] Started Fluentd Forward Instance", f.name)
+	for {
+		select {
+		case <-f.term:
+			log.Println("Fluentd forward server received term signal")
+			return nil
+		default:
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Printf("Error accepting connection: %v", err)
+				continue
+			}
+			go f.forwardConn(conn)
+		}
+	}
+}
+
+func (f *ForwardServer) Stop() error {
+	f.term <- true
+	return nil
+}
@@ -0,0 +1,248 @@
+package fluentforward
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/vmihailenco/msgpack"
+)
+
+// eventTime is the Fluentd EventTime extension type (ext 0): seconds and
+// nanoseconds as two big endian 32 bit integers
+type eventTime struct {
+	time.Time
+}
+
+func init() {
+	msgpack.RegisterExt(0, (*eventTime)(nil))
+}
+
+func (t *eventTime) UnmarshalMsgpack(b []byte) error {
+	if len(b) != 8 {
+		return fmt.Errorf("invalid EventTime length %d", len(b))
+	}
+	sec := binary.BigEndian.Uint32(b[0:4])
+	nsec := binary.BigEndian.Uint32(b[4:8])
+	t.Time = time.Unix(int64(sec), int64(nsec))
+	return nil
+}
+
+func (t *eventTime) MarshalMsgpack() ([]byte, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b[0:4], uint32(t.Unix()))
+	binary.BigEndian.PutUint32(b[4:8], uint32(t.Nanosecond()))
+	return b, nil
+}
+
+// entry is a single [time, record] pair
+type entry struct {
+	Time   time.Time
+	Record map[string]interface{}
+}
+
+// toTime converts the time of an entry, which is either an integer number
+// of seconds or an EventTime
+func toTime(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case *eventTime:
+		return v.Time, nil
+	case int8:
+		return time.Unix(int64(v), 0), nil
+	case int16:
+		return time.Unix(int64(v), 0), nil
+	case int32:
+		return time.Unix(int64(v), 0), nil
+	case int64:
+		return time.Unix(v, 0), nil
+	case uint8:
+		return time.Unix(int64(v), 0), nil
+	case uint16:
+		return time.Unix(int64(v), 0), nil
+	case uint32:
+		return time.Unix(int64(v), 0), nil
+	case uint64:
+		return time.Unix(int64(v), 0), nil
+	case float32:
+		return time.Unix(0, int64(float64(v)*float64(time.Second))), nil
+	case float64:
+		return time.Unix(0, int64(v*float64(time.Second))), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid event time %T", value)
+}
+
+// toRecord normalises a decoded record. Binary values are converted to
+// strings so they can be matched by routes and encoded as JSON.
+func toRecord(value interface{}) (map[string]interface{}, error) {
+	record, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid record %T", value)
+	}
+
+	for key, v := range record {
+		record[key] = normalise(v)
+	}
+
+	return record, nil
+}
+
+func normalise(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalise(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalise(item)
+		}
+	}
+	return value
+}
+
+func toEntry(value interface{}) (*entry, error) {
+	pair, ok := value.([]interface{})
+	if !ok || len(pair) != 2 {
+		return nil, errors.New("entry is not a [time, record] pair")
+	}
+
+	t, err := toTime(pair[0])
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := toRecord(pair[1])
+	if err != nil {
+		return nil, err
+	}
+
+	return &entry{Time: t, Record: record}, nil
+}
+
+// unpackEntries decodes the msgpack stream of entries carried by the
+// PackedForward and CompressedPackedForward modes
+func unpackEntries(packed []byte, compressed bool) ([]*entry, error) {
+	var r io.Reader = bytes.NewReader(packed)
+
+	if compressed {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	var entries []*entry
+	decoder := msgpack.NewDecoder(r)
+
+	for {
+		value, err := decoder.DecodeInterface()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := toEntry(value)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+}
+
+// message is a decoded Message, Forward, PackedForward or
+// CompressedPackedForward mode event
+type message struct {
+	Tag     string
+	Entries []*entry
+	Chunk   string
+}
+
+func toMessage(value interface{}) (*message, error) {
+	fields, ok := value.([]interface{})
+	if !ok || len(fields) < 2 {
+		return nil, errors.New("message is not an array")
+	}
+
+	tag, ok := toString(fields[0])
+	if !ok {
+		return nil, errors.New("missing tag")
+	}
+
+	msg := &message{Tag: tag}
+	var options map[string]interface{}
+
+	switch v := fields[1].(type) {
+	case []interface{}:
+		// Forward mode: [tag, [[time, record], ...], option]
+		for _, item := range v {
+			e, err := toEntry(item)
+			if err != nil {
+				return nil, err
+			}
+			msg.Entries = append(msg.Entries, e)
+		}
+		if len(fields) > 2 {
+			options, _ = fields[2].(map[string]interface{})
+		}
+	case []byte, string:
+		// PackedForward mode: [tag, packed entries, option]
+		if len(fields) > 2 {
+			options, _ = fields[2].(map[string]interface{})
+		}
+		packed, _ := toString(v)
+		compressed, _ := toString(options["compressed"])
+		entries, err := unpackEntries([]byte(packed), compressed == "gzip")
+		if err != nil {
+			return nil, err
+		}
+		msg.Entries = entries
+	default:
+		// Message mode: [tag, time, record, option]
+		if len(fields) < 3 {
+			return nil, errors.New("message mode event is missing a record")
+		}
+		e, err := toEntry([]interface{}{fields[1], fields[2]})
+		if err != nil {
+			return nil, err
+		}
+		msg.Entries = []*entry{e}
+		if len(fields) > 3 {
+			options, _ = fields[3].(map[string]interface{})
+		}
+	}
+
+	msg.Chunk, _ = toString(options["chunk"])
+
+	return msg, nil
+}
+
+func toString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case []byte:
+		return string(v), true
+	}
+	return "", false
+}
+
+// digest computes the hex encoded SHA-512 used by the handshake messages
+func digest(parts ...string) string {
+	h := sha512.New()
+	for _, part := range parts {
+		io.WriteString(h, part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,160 @@
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+const (
+	chunkHeaderLen = 12
+	maxChunks      = 128
+	chunkTimeout   = 5 * time.Second
+
+	// Bounds on incomplete messages, so a flood of first chunks can't
+	// exhaust memory
+	maxPendingMessages = 1024
+	maxPendingBytes    = 32 * 1024 * 1024
+)
+
+var chunkMagic = []byte{0x1e, 0x0f}
+
+// chunkedMessage collects the chunks of a single GELF message
+type chunkedMessage struct {
+	chunks   [][]byte
+	received int
+	size     int
+	first    time.Time
+}
+
+// assembler reassembles chunked UDP messages. Incomplete messages are
+// dropped after chunkTimeout, as required by the GELF specification.
+type assembler struct {
+	mtx      sync.Mutex
+	messages map[string]*chunkedMessage
+	size     int
+}
+
+func newAssembler() *assembler {
+	return &assembler{messages: make(map[string]*chunkedMessage)}
+}
+
+// add returns the complete message once all chunks have arrived, or nil if
+// more chunks are expected
+func (a *assembler) add(packet []byte) ([]byte, error) {
+	if len(packet) <= chunkHeaderLen {
+		return nil, errors.New("chunk too short")
+	}
+
+	id := string(packet[2:10])
+	seq := int(packet[10])
+	count := int(packet[11])
+
+	if count == 0 || count > maxChunks || seq >= count {
+		return nil, errors.New("invalid chunk sequence")
+	}
+
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	msg, ok := a.messages[id]
+	if !ok {
+		if len(a.messages) >= maxPendingMessages {
+			a.dropOldest()
+		}
+		msg = &chunkedMessage{chunks: make([][]byte, count), first: time.Now()}
+		a.messages[id] = msg
+	}
+
+	if len(msg.chunks) != count {
+		a.remove(id)
+		return nil, errors.New("chunk count changed within message")
+	}
+
+	if msg.chunks[seq] == nil {
+		chunk := append([]byte{}, packet[chunkHeaderLen:]...)
+		msg.chunks[seq] = chunk
+		msg.received++
+		msg.size += len(chunk)
+		a.size += len(chunk)
+	}
+
+	if msg.received < count {
+		for a.size > maxPendingBytes && len(a.messages) > 1 {
+			a.dropOldest()
+		}
+		if _, ok := a.messages[id]; !ok {
+			return nil, errors.New("too many incomplete messages")
+		}
+		return nil, nil
+	}
+
+	a.remove(id)
+	return bytes.Join(msg.chunks, nil), nil
+}
+
+// remove forgets an incomplete message. The lock must be held.
+func (a *assembler) remove(id string) {
+	if msg, ok := a.messages[id]; ok {
+		a.size -= msg.size
+		delete(a.messages, id)
+	}
+}
+
+// dropOldest makes room by dropping the incomplete message that started
+// first. The lock must be held.
+func (a *assembler) dropOldest() {
+	var oldest string
+	var first time.Time
+
+	for id, msg := range a.messages {
+		if len(oldest) == 0 || msg.first.Before(first) {
+			oldest, first = id, msg.first
+		}
+	}
+
+	a.remove(oldest)
+}
+
+// expire drops messages whose chunks did not all arrive in time
+func (a *assembler) expire() int {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	dropped := 0
+	for id, msg := range a.messages {
+		if time.Since(msg.first) > chunkTimeout {
+			a.remove(id)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// decompress detects gzip and zlib payloads and inflates them. Anything
+// else is assumed to be uncompressed JSON.
+func decompress(payload []byte) ([]byte, error) {
+	switch {
+	case len(payload) > 2 && payload[0] == 0x1f && payload[1] == 0x8b:
+		r, err := gzip.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(io.LimitReader(r, maxMessageLen))
+	case len(payload) > 2 && payload[0] == 0x78:
+		r, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(io.LimitReader(r, maxMessageLen))
+	}
+
+	return payload, nil
+}
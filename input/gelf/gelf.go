@@ -0,0 +1,272 @@
+package gelf
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/packetzoom/logzoom/buffer"
+	"github.com/packetzoom/logzoom/input"
+	"github.com/packetzoom/logzoom/server"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	maxPacketLen  = 65536
+	maxMessageLen = 8 * 1024 * 1024 // 8 mb
+)
+
+type Config struct {
+	UDPHost    string `yaml:"udp_host"`
+	TCPHost    string `yaml:"tcp_host"`
+	SampleSize *int   `yaml:"sample_size,omitempty"`
+}
+
+type GELFInputServer struct {
+	name      string
+	config    Config
+	receiver  input.Receiver
+	assembler *assembler
+	term      chan bool
+}
+
+func init() {
+	input.Register("gelf", New)
+}
+
+func New() input.Input {
+	return &GELFInputServer{term: make(chan bool, 1)}
+}
+
+// toEvent maps a GELF message onto an event. The raw JSON becomes the
+// event text and its fields, with the leading underscore of additional
+// fields removed, become the event fields so routes can match on them.
+func toEvent(payload []byte, remote string) (*buffer.Event, error) {
+	var message map[string]interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&message); err != nil {
+		return nil, err
+	}
+
+	if _, ok := message["short_message"]; !ok {
+		return nil, errors.New("missing short_message")
+	}
+
+	fields := make(map[string]interface{}, len(message))
+	for key, value := range message {
+		if strings.HasPrefix(key, "_") && len(key) > 1 {
+			key = key[1:]
+		}
+		fields[key] = value
+	}
+
+	host, _ := fields["host"].(string)
+	if len(host) == 0 {
+		host = remote
+	}
+
+	text := string(payload)
+	ev := &buffer.Event{
+		Source: fmt.Sprintf("gelf://%s", host),
+		Text:   &text,
+		Fields: &fields,
+	}
+
+	return ev, nil
+}
+
+func (g *GELFInputServer) send(payload []byte, remote string) {
+	ev, err := toEvent(payload, remote)
+	if err != nil {
+		log.Printf("[%s] Error decoding GELF message from %s: %v", g.name, remote, err)
+		return
+	}
+
+	if server.RandInt(0, 100) < *g.config.SampleSize {
+		g.receiver.Send(ev)
+	}
+}
+
+func (g *GELFInputServer) handlePacket(packet []byte, remote string) {
+	if bytes.HasPrefix(packet, chunkMagic) {
+		message, err := g.assembler.add(packet)
+		if err != nil {
+			log.Printf("[%s] Dropping chunk from %s: %v", g.name, remote, err)
+			return
+		}
+		if message == nil {
+			return
+		}
+		packet = message
+	}
+
+	payload, err := decompress(packet)
+	if err != nil {
+		log.Printf("[%s] Error decompressing GELF message from %s: %v", g.name, remote, err)
+		return
+	}
+
+	g.send(payload, remote)
+}
+
+func (g *GELFInputServer) serveUDP(conn net.PacketConn) {
+	packet := make([]byte, maxPacketLen)
+
+	for {
+		n, addr, err := conn.ReadFrom(packet)
+		if err != nil {
+			log.Printf("[%s] Error reading UDP packet: %v", g.name, err)
+			return
+		}
+
+		host, _, _ := net.SplitHostPort(addr.String())
+		g.handlePacket(append([]byte{}, packet[:n]...), host)
+	}
+}
+
+// expireChunks drops incomplete chunked messages until stop is closed
+func (g *GELFInputServer) expireChunks(stop chan bool) {
+	ticker := time.NewTicker(chunkTimeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if dropped := g.assembler.expire(); dropped > 0 {
+				log.Printf("[%s] Dropped %d incomplete chunked messages", g.name, dropped)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// tcpConn reads null byte delimited messages from a TCP client
+func (g *GELFInputServer) tcpConn(c net.Conn) {
+	defer c.Close()
+
+	remote := c.RemoteAddr().String()
+	host, _, _ := net.SplitHostPort(remote)
+	log.Printf("[%s] accepting GELF connection", remote)
+
+	scanner := bufio.NewScanner(c)
+	scanner.Buffer(make([]byte, 0, maxPacketLen), maxMessageLen)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, 0); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		g.send(append([]byte{}, scanner.Bytes()...), host)
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Printf("[%s] error reading %v", remote, err)
+	}
+	log.Printf("[%s] closing GELF connection", remote)
+}
+
+func (g *GELFInputServer) serveTCP(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Error accepting connection: %v", err)
+			continue
+		}
+		go g.tcpConn(conn)
+	}
+}
+
+func (g *GELFInputServer) ValidateConfig(config *Config) error {
+	if len(config.UDPHost) == 0 && len(config.TCPHost) == 0 {
+		return errors.New("Missing udp_host or tcp_host")
+	}
+
+	if g.config.SampleSize == nil {
+		i := 100
+		g.config.SampleSize = &i
+	}
+	log.Printf("[%s] Setting Sample Size to %d", g.name, *g.config.SampleSize)
+
+	return nil
+}
+
+func (g *GELFInputServer) Init(name string, config yaml.MapSlice, receiver input.Receiver) error {
+	var gelfConfig *Config
+
+	// go-yaml doesn't have a great way to partially unmarshal YAML data
+	// See https://github.com/go-yaml/yaml/issues/13
+	yamlConfig, _ := yaml.Marshal(config)
+
+	if err := yaml.Unmarshal(yamlConfig, &gelfConfig); err != nil {
+		return fmt.Errorf("Error parsing GELF config: %v", err)
+	}
+
+	g.name = name
+	g.config = *gelfConfig
+	g.receiver = receiver
+	g.assembler = newAssembler()
+
+	if err := g.ValidateConfig(gelfConfig); err != nil {
+		return fmt.Errorf("Error in config: %v", err)
+	}
+
+	return nil
+}
+
+func (g *GELFInputServer) Start() error {
+	stop := make(chan bool)
+	defer close(stop)
+
+	if len(g.config.UDPHost) > 0 {
+		conn, err := net.ListenPacket("udp", g.config.UDPHost)
+		if err != nil {
+			return fmt.Errorf("UDP listener failed: %v", err)
+		}
+		defer conn.Close()
+
+		go g.expireChunks(stop)
+		go g.serveUDP(conn)
+		log.Printf("[%s] Listening for GELF on udp %s", g.name, g.config.UDPHost)
+	}
+
+	if len(g.config.TCPHost) > 0 {
+		ln, err := net.Listen("tcp", g.config.TCPHost)
+		if err != nil {
+			return fmt.Errorf("TCP listener failed: %v", err)
+		}
+		defer ln.Close()
+
+		go g.serveTCP(ln)
+		log.Printf("[%s] Listening for GELF on tcp %s", g.name, g.config.TCPHost)
+	}
+
+	<-g.term
+	log.Println("GELF input server received term signal")
+	return nil
+}
+
+func (g *GELFInputServer) Stop() error {
+	g.term <- true
+	return nil
+}
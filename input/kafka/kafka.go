@@ -0,0 +1,284 @@
+package kafka
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/packetzoom/logzoom/buffer"
+	"github.com/packetzoom/logzoom/input"
+	"github.com/packetzoom/logzoom/server"
+	"github.com/paulbellamy/ratecounter"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultVersion        = "1.0.0"
+	defaultCommitInterval = 1
+	rateDisplayInterval   = 10
+)
+
+type Config struct {
+	Brokers        []string `yaml:"brokers"`
+	GroupID        string   `yaml:"group_id"`
+	Topics         []string `yaml:"topics"`
+	ClientID       string   `yaml:"client_id"`
+	Version        string   `yaml:"version"`
+	InitialOffset  string   `yaml:"initial_offset"`
+	CommitInterval int      `yaml:"commit_interval"`
+	JsonDecode     bool     `yaml:"json_decode"`
+	SampleSize     *int     `yaml:"sample_size,omitempty"`
+}
+
+type KafkaInputServer struct {
+	name        string
+	config      Config
+	receiver    input.Receiver
+	rateCounter *ratecounter.RateCounter
+	decodeErrs  uint64
+	term        chan bool
+}
+
+func init() {
+	input.Register("kafka", New)
+}
+
+func New() input.Input {
+	return &KafkaInputServer{term: make(chan bool, 1)}
+}
+
+// toEvent maps a Kafka message onto an event. The topic, partition, offset,
+// key and headers are recorded in the fields so routes can match on them.
+// If json_decode is set and the payload is not JSON, the event is still
+// returned with the raw payload as text, along with the decode error.
+func (k *KafkaInputServer) toEvent(msg *sarama.ConsumerMessage) (*buffer.Event, error) {
+	var ev buffer.Event
+	payload := string(msg.Value)
+	ev.Text = &payload
+	ev.Source = fmt.Sprintf("kafka://%s/%d", msg.Topic, msg.Partition)
+	ev.Offset = msg.Offset
+
+	fields := make(map[string]interface{})
+
+	var decodeErr error
+	if k.config.JsonDecode {
+		decoder := json.NewDecoder(strings.NewReader(payload))
+		decoder.UseNumber()
+
+		decodeErr = decoder.Decode(&fields)
+		if decodeErr == nil && fields == nil {
+			decodeErr = errors.New("payload is not a JSON object")
+		}
+		if decodeErr != nil {
+			fields = make(map[string]interface{})
+		}
+	}
+
+	fields["kafka_topic"] = msg.Topic
+	fields["kafka_partition"] = msg.Partition
+	fields["kafka_offset"] = msg.Offset
+
+	if len(msg.Key) > 0 {
+		fields["kafka_key"] = string(msg.Key)
+	}
+
+	if len(msg.Headers) > 0 {
+		headers := make(map[string]interface{}, len(msg.Headers))
+		for _, header := range msg.Headers {
+			headers[string(header.Key)] = string(header.Value)
+		}
+		fields["kafka_headers"] = headers
+	}
+
+	ev.Fields = &fields
+	return &ev, decodeErr
+}
+
+func (k *KafkaInputServer) Setup(session sarama.ConsumerGroupSession) error {
+	log.Printf("[%s] Joined consumer group %s, claims: %v", k.name, k.config.GroupID, session.Claims())
+	return nil
+}
+
+func (k *KafkaInputServer) Cleanup(sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim hands each message to the receiver before marking it, so
+// offsets are only committed for events that reached the buffer. Messages
+// that fail JSON decoding are logged, counted and forwarded as plain text.
+func (k *KafkaInputServer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for msg := range claim.Messages() {
+		k.rateCounter.Incr(1)
+
+		ev, err := k.toEvent(msg)
+		if err != nil {
+			atomic.AddUint64(&k.decodeErrs, 1)
+			log.Printf("[%s] Error decoding message at %s/%d offset %d: %v", k.name, msg.Topic, msg.Partition, msg.Offset, err)
+		}
+
+		if server.RandInt(0, 100) < *k.config.SampleSize {
+			k.receiver.Send(ev)
+		}
+
+		session.MarkMessage(msg, "")
+	}
+
+	return nil
+}
+
+func (k *KafkaInputServer) ValidateConfig(config *Config) error {
+	if len(config.Brokers) == 0 {
+		return errors.New("Missing brokers")
+	}
+
+	if len(config.GroupID) == 0 {
+		return errors.New("Missing consumer group id")
+	}
+
+	if len(config.Topics) == 0 {
+		return errors.New("Missing topics")
+	}
+
+	if len(k.config.ClientID) == 0 {
+		k.config.ClientID = "logzoom"
+	}
+
+	if len(k.config.Version) == 0 {
+		k.config.Version = defaultVersion
+	}
+
+	switch k.config.InitialOffset {
+	case "":
+		k.config.InitialOffset = "newest"
+	case "oldest", "newest":
+	default:
+		return fmt.Errorf("Unknown initial offset %s (must be oldest or newest)", config.InitialOffset)
+	}
+
+	if k.config.CommitInterval <= 0 {
+		k.config.CommitInterval = defaultCommitInterval
+	}
+
+	if k.config.SampleSize == nil {
+		i := 100
+		k.config.SampleSize = &i
+	}
+	log.Printf("[%s] Setting Sample Size to %d", k.name, *k.config.SampleSize)
+
+	return nil
+}
+
+func (k *KafkaInputServer) Init(name string, config yaml.MapSlice, receiver input.Receiver) error {
+	var kafkaConfig *Config
+
+	// go-yaml doesn't have a great way to partially unmarshal YAML data
+	// See https://github.com/go-yaml/yaml/issues/13
+	yamlConfig, _ := yaml.Marshal(config)
+
+	if err := yaml.Unmarshal(yamlConfig, &kafkaConfig); err != nil {
+		return fmt.Errorf("Error parsing Kafka config: %v", err)
+	}
+
+	k.name = name
+	k.config = *kafkaConfig
+	k.receiver = receiver
+	k.rateCounter = ratecounter.NewRateCounter(1 * time.Second)
+
+	if err := k.ValidateConfig(kafkaConfig); err != nil {
+		return fmt.Errorf("Error in config: %v", err)
+	}
+
+	return nil
+}
+
+func (k *KafkaInputServer) saramaConfig() (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	config.ClientID = k.config.ClientID
+
+	version, err := sarama.ParseKafkaVersion(k.config.Version)
+	if err != nil {
+		return nil, err
+	}
+	config.Version = version
+
+	config.Consumer.Return.Errors = true
+	config.Consumer.Offsets.AutoCommit.Enable = true
+	config.Consumer.Offsets.AutoCommit.Interval = time.Duration(k.config.CommitInterval) * time.Second
+
+	if k.config.InitialOffset == "oldest" {
+		config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	} else {
+		config.Consumer.Offsets.Initial = sarama.OffsetNewest
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+func (k *KafkaInputServer) consume(ctx context.Context, group sarama.ConsumerGroup) {
+	for {
+		// Consume returns at every rebalance and must be called again
+		if err := group.Consume(ctx, k.config.Topics, k); err != nil {
+			log.Printf("[%s] Error consuming from Kafka: %s, sleeping", k.name, err)
+			time.Sleep(2 * time.Second)
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+func (k *KafkaInputServer) Start() error {
+	log.Printf("Starting Kafka input on topics %v, consumer group: %s",
+		k.config.Topics, k.config.GroupID)
+
+	config, err := k.saramaConfig()
+	if err != nil {
+		return fmt.Errorf("Error in Kafka config: %v", err)
+	}
+
+	group, err := sarama.NewConsumerGroup(k.config.Brokers, k.config.GroupID, config)
+	if err != nil {
+		log.Println("Error opening Kafka input")
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go k.consume(ctx, group)
+
+	tick := time.NewTicker(time.Duration(rateDisplayInterval) * time.Second)
+	defer tick.Stop()
+
+	for {
+		select {
+		case err := <-group.Errors():
+			log.Printf("[%s] Kafka consumer error: %v", k.name, err)
+		case <-tick.C:
+			if k.rateCounter.Rate() > 0 {
+				log.Printf("[%s] Current Kafka input rate: %d/s\n", k.name, k.rateCounter.Rate())
+			}
+			if errs := atomic.SwapUint64(&k.decodeErrs, 0); errs > 0 {
+				log.Printf("[%s] %d messages failed JSON decoding in the last %ds\n", k.name, errs, rateDisplayInterval)
+			}
+		case <-k.term:
+			log.Println("Kafka input server received term signal")
+			cancel()
+			return group.Close()
+		}
+	}
+}
+
+func (k *KafkaInputServer) Stop() error {
+	k.term <- true
+	return nil
+}
@@ -0,0 +1,189 @@
+package redis
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	goredis "github.com/go-redis/redis"
+	"github.com/packetzoom/logzoom/redisconn"
+	"github.com/paulbellamy/ratecounter"
+)
+
+const (
+	modeRedisMQ = "redismq"
+	modeList    = "list"
+	modePubSub  = "pubsub"
+	modeStream  = "stream"
+
+	defaultMessageField = "message"
+	blockTimeout        = 5 * time.Second
+)
+
+// listGet pops payloads pushed with RPUSH by any producer
+func (redisServer *RedisInputServer) listGet(client goredis.UniversalClient, stop chan bool) {
+	rateCounter := ratecounter.NewRateCounter(1 * time.Second)
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		result, err := client.BLPop(blockTimeout, redisServer.config.InputQueue).Result()
+
+		if err == goredis.Nil {
+			continue
+		}
+
+		if err != nil {
+			log.Printf("Error reading from Redis: %s, sleeping", err)
+			time.Sleep(2 * time.Second)
+			continue
+		}
+
+		// BLPOP returns the key followed by the value
+		rateCounter.Incr(1)
+		redisServer.send(result[1])
+	}
+}
+
+// pubSubGet receives messages published on a channel, or on all channels
+// matching a pattern
+func (redisServer *RedisInputServer) pubSubGet(client goredis.UniversalClient, stop chan bool) {
+	var pubsub *goredis.PubSub
+
+	if redisServer.config.Pattern {
+		pubsub = client.PSubscribe(redisServer.config.InputQueue)
+	} else {
+		pubsub = client.Subscribe(redisServer.config.InputQueue)
+	}
+	defer pubsub.Close()
+
+	messages := pubsub.Channel()
+
+	for {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			redisServer.send(msg.Payload)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// streamPayload returns the configured message field of a stream entry, or
+// all of its values encoded as JSON when the field is absent
+func (redisServer *RedisInputServer) streamPayload(msg goredis.XMessage) string {
+	if value, ok := msg.Values[redisServer.config.MessageField]; ok {
+		if s, ok := value.(string); ok {
+			return s
+		}
+	}
+
+	b, _ := json.Marshal(msg.Values)
+	return string(b)
+}
+
+// streamGet reads a stream as part of a consumer group. Entries left
+// pending by a previous run of this consumer are processed first, and each
+// entry is acked once it has been handed to the receiver.
+func (redisServer *RedisInputServer) streamGet(client goredis.UniversalClient, stop chan bool) {
+	stream := redisServer.config.InputQueue
+	group := redisServer.config.ConsumerGroup
+
+	err := client.XGroupCreateMkStream(stream, group, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		log.Printf("Error creating Redis consumer group %s: %s", group, err)
+	}
+
+	// "0" reads our pending entries, ">" reads new ones
+	id := "0"
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		streams, err := client.XReadGroup(&goredis.XReadGroupArgs{
+			Group:    group,
+			Consumer: redisServer.config.ConsumerName,
+			Streams:  []string{stream, id},
+			Count:    recvBuffer,
+			Block:    blockTimeout,
+		}).Result()
+
+		if err == goredis.Nil {
+			continue
+		}
+
+		if err != nil {
+			log.Printf("Error reading from Redis: %s, sleeping", err)
+			time.Sleep(2 * time.Second)
+			continue
+		}
+
+		for _, s := range streams {
+			if len(s.Messages) == 0 && id == "0" {
+				log.Printf("[%s] Finished processing pending entries", redisServer.name)
+				id = ">"
+			}
+
+			ids := make([]string, 0, len(s.Messages))
+			for _, msg := range s.Messages {
+				redisServer.send(redisServer.streamPayload(msg))
+				ids = append(ids, msg.ID)
+			}
+
+			if len(ids) > 0 {
+				if err := client.XAck(stream, group, ids...).Err(); err != nil {
+					log.Println("Failed to ack", err)
+				}
+			}
+		}
+	}
+}
+
+// startClient runs the list, pubsub and stream modes, which use plain Redis
+// commands rather than the redismq queue layout. On a term signal the
+// consumer is stopped before the client is closed.
+func (redisServer *RedisInputServer) startClient() error {
+	log.Printf("Starting Redis input in %s mode on %s",
+		redisServer.config.Mode,
+		redisServer.config.InputQueue)
+
+	client, err := redisconn.NewClient(redisServer.config.Config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	stop := make(chan bool)
+	done := make(chan bool)
+
+	go func() {
+		defer close(done)
+
+		switch redisServer.config.Mode {
+		case modeList:
+			redisServer.listGet(client, stop)
+		case modePubSub:
+			redisServer.pubSubGet(client, stop)
+		case modeStream:
+			redisServer.streamGet(client, stop)
+		}
+	}()
+
+	<-redisServer.term
+	log.Println("Redis input server received term signal")
+	close(stop)
+	<-done
+	return nil
+}
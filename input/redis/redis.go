@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -12,23 +13,27 @@ import (
 	"github.com/adjust/redismq"
 	"github.com/packetzoom/logzoom/buffer"
 	"github.com/packetzoom/logzoom/input"
+	"github.com/packetzoom/logzoom/redisconn"
 	"github.com/packetzoom/logzoom/server"
 	"github.com/paulbellamy/ratecounter"
 	"gopkg.in/yaml.v2"
 )
 
 const (
-	recvBuffer = 10000
+	recvBuffer            = 10000
+	sentinelCheckInterval = 5
 )
 
 type Config struct {
-	Host         string `yaml:"host"`
-	Port         int    `yaml:"port"`
-	Db           int64  `yaml:"db"`
-	Password     string `yaml:"password"`
-	InputQueue   string `yaml:"input_queue"`
-	JsonDecode   bool   `yaml:"json_decode"`
-	SampleSize   *int   `yaml:"sample_size,omitempty"`
+	redisconn.Config `yaml:",inline"`
+	InputQueue       string `yaml:"input_queue"`
+	Mode             string `yaml:"mode"`
+	Pattern          bool   `yaml:"pattern"`
+	ConsumerGroup    string `yaml:"consumer_group"`
+	ConsumerName     string `yaml:"consumer_name"`
+	MessageField     string `yaml:"message_field"`
+	JsonDecode       bool   `yaml:"json_decode"`
+	SampleSize       *int   `yaml:"sample_size,omitempty"`
 }
 
 type RedisInputServer struct {
@@ -46,11 +51,39 @@ func New() input.Input {
 	return &RedisInputServer{term: make(chan bool, 1)}
 }
 
-func redisGet(redisServer *RedisInputServer, consumer *redismq.Consumer) error {
-	consumer.ResetWorking()
+// send decodes a payload read from Redis and hands it to the receiver
+func (redisServer *RedisInputServer) send(payload string) {
+	var ev buffer.Event
+	ev.Text = &payload
+
+	if redisServer.config.JsonDecode {
+		decoder := json.NewDecoder(strings.NewReader(payload))
+		decoder.UseNumber()
+
+		err := decoder.Decode(&ev.Fields)
+
+		if err != nil {
+			return
+		}
+	}
+
+	if server.RandInt(0, 100) < *redisServer.config.SampleSize {
+		redisServer.receiver.Send(&ev)
+	}
+}
+
+// redisGet reads from the queue until stop is closed. Messages left in the
+// working queue, e.g. by a crash or a failover, are requeued first.
+func redisGet(redisServer *RedisInputServer, consumer *redismq.Consumer, stop chan bool) error {
 	rateCounter := ratecounter.NewRateCounter(1 * time.Second)
 
 	for {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
 		unacked := consumer.GetUnackedLength()
 
 		if unacked > 0 {
@@ -73,24 +106,7 @@ func redisGet(redisServer *RedisInputServer, consumer *redismq.Consumer) error {
 			}
 
 			for i := range packages {
-				var ev buffer.Event
-				payload := string(packages[i].Payload)
-				ev.Text = &payload
-
-				if redisServer.config.JsonDecode {
-					decoder := json.NewDecoder(strings.NewReader(payload))
-					decoder.UseNumber()
-
-					err = decoder.Decode(&ev.Fields)
-
-					if err != nil {
-						continue
-					}
-				}
-
-				if server.RandInt(0, 100) < *redisServer.config.SampleSize {
-					redisServer.receiver.Send(&ev)
-				}
+				redisServer.send(string(packages[i].Payload))
 			}
 		} else {
 			log.Printf("Error reading from Redis: %s, sleeping", err)
@@ -102,18 +118,42 @@ func redisGet(redisServer *RedisInputServer, consumer *redismq.Consumer) error {
 }
 
 func (redisServer *RedisInputServer) ValidateConfig(config *Config) error {
-	if len(config.Host) == 0 {
-		return errors.New("Missing Redis host")
-	}
-
-	if config.Port <= 0 {
-		return errors.New("Missing Redis port")
+	if err := config.Validate(); err != nil {
+		return err
 	}
 
 	if len(config.InputQueue) == 0 {
 		return errors.New("Missing Redis input queue name")
 	}
 
+	switch redisServer.config.Mode {
+	case "":
+		redisServer.config.Mode = modeRedisMQ
+	case modeRedisMQ:
+		if len(config.ClusterAddrs) > 0 {
+			return errors.New("Redis Cluster requires the list, pubsub or stream mode")
+		}
+		if config.TLS {
+			return errors.New("TLS requires the list, pubsub or stream mode")
+		}
+	case modeList, modePubSub:
+	case modeStream:
+		if len(config.ConsumerGroup) == 0 {
+			return errors.New("Missing Redis stream consumer group")
+		}
+	default:
+		return fmt.Errorf("Unknown Redis mode %s", config.Mode)
+	}
+
+	if len(redisServer.config.ConsumerName) == 0 {
+		hostname, _ := os.Hostname()
+		redisServer.config.ConsumerName = hostname + "-" + redisServer.name
+	}
+
+	if len(redisServer.config.MessageField) == 0 {
+		redisServer.config.MessageField = defaultMessageField
+	}
+
 	if redisServer.config.SampleSize == nil {
 		i := 100
 		redisServer.config.SampleSize = &i
@@ -145,38 +185,77 @@ func (redisServer *RedisInputServer) Init(name string, config yaml.MapSlice, rec
 	return nil
 }
 
+// openConsumer creates the redismq queue and consumer on the given server
+func (redisServer *RedisInputServer) openConsumer(host string, port int) (*redismq.Consumer, error) {
+	queue := redismq.CreateQueue(host,
+		strconv.Itoa(port),
+		redisServer.config.Password,
+		redisServer.config.Db,
+		redisServer.config.InputQueue)
+
+	return queue.AddConsumer(redisServer.config.InputQueue + "_working")
+}
+
 func (redisServer *RedisInputServer) Start() error {
+	if redisServer.config.Mode != modeRedisMQ {
+		return redisServer.startClient()
+	}
+
 	log.Printf("Starting Redis input on input queue: %s, working queue: %s",
 		redisServer.config.InputQueue,
 		redisServer.config.InputQueue + "_working")
 
-	port := strconv.Itoa(redisServer.config.Port)
+	host, port, err := redisconn.MasterAddr(redisServer.config.Config)
 
-	// Create Redis queue
-	queue := redismq.CreateQueue(redisServer.config.Host,
-		port,
-		redisServer.config.Password,
-		redisServer.config.Db,
-		redisServer.config.InputQueue)
+	for err != nil {
+		log.Printf("Error finding Redis master: %s, sleeping", err)
+		time.Sleep(2 * time.Second)
+		host, port, err = redisconn.MasterAddr(redisServer.config.Config)
+	}
 
-	consumer, err := queue.AddConsumer(redisServer.config.InputQueue + "_working")
+	consumer, err := redisServer.openConsumer(host, port)
 
 	if err != nil {
 		log.Println("Error opening Redis input")
 		return err
 	}
 
-	go redisGet(redisServer, consumer)
+	stop := make(chan bool)
+	go redisGet(redisServer, consumer, stop)
+
+	tick := time.NewTicker(time.Duration(sentinelCheckInterval) * time.Second)
+	defer tick.Stop()
 
 	for {
 		select {
+		case <-tick.C:
+			if len(redisServer.config.SentinelMaster) == 0 {
+				continue
+			}
+
+			newHost, newPort, err := redisconn.MasterAddr(redisServer.config.Config)
+			if err != nil || (newHost == host && newPort == port) {
+				continue
+			}
+
+			log.Printf("[%s] Redis master moved from %s:%d to %s:%d", redisServer.name, host, port, newHost, newPort)
+
+			consumer, err = redisServer.openConsumer(newHost, newPort)
+			if err != nil {
+				log.Printf("Error opening Redis input on new master: %s", err)
+				continue
+			}
+
+			close(stop)
+			stop = make(chan bool)
+			host, port = newHost, newPort
+			go redisGet(redisServer, consumer, stop)
 		case <-redisServer.term:
 			log.Println("Redis input server received term signal")
+			close(stop)
 			return nil
 		}
 	}
-
-	return nil
 }
 
 func (redisServer *RedisInputServer) Stop() error {
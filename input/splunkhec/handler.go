@@ -0,0 +1,309 @@
+package splunkhec
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/packetzoom/logzoom/buffer"
+	"github.com/packetzoom/logzoom/server"
+)
+
+// HEC status codes, as returned by Splunk
+const (
+	codeSuccess      = 0
+	codeNoAuth       = 2
+	codeInvalidToken = 4
+	codeNoData       = 5
+	codeInvalidData  = 6
+	codeBadRequest   = 7
+	codeNoEvent      = 12
+	codeHealthy      = 17
+)
+
+// metadata holds the Splunk fields that may be set per request or per event
+type metadata struct {
+	Index      string
+	Sourcetype string
+	Source     string
+	Host       string
+}
+
+// hecEvent is an entry posted to the event endpoint
+type hecEvent struct {
+	Time       interface{}            `json:"time"`
+	Host       string                 `json:"host"`
+	Source     string                 `json:"source"`
+	Sourcetype string                 `json:"sourcetype"`
+	Index      string                 `json:"index"`
+	Event      interface{}            `json:"event"`
+	Fields     map[string]interface{} `json:"fields"`
+}
+
+func reply(w http.ResponseWriter, status int, code int, text string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"text":%q,"code":%d}`, text, code)
+}
+
+// authorized checks the "Authorization: Splunk <token>" header against the
+// configured tokens
+func (s *HECServer) authorized(r *http.Request) (bool, int) {
+	if len(s.config.Tokens) == 0 {
+		return true, codeSuccess
+	}
+
+	auth := r.Header.Get("Authorization")
+	if len(auth) == 0 {
+		return false, codeNoAuth
+	}
+
+	token := strings.TrimSpace(strings.TrimPrefix(auth, "Splunk "))
+	for _, t := range s.config.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true, codeSuccess
+		}
+	}
+
+	return false, codeInvalidToken
+}
+
+func body(r *http.Request) (io.ReadCloser, error) {
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		return gzip.NewReader(r.Body)
+	}
+	return r.Body, nil
+}
+
+// toEvent builds an event for the buffer. Object events are used as the
+// event fields; the Splunk metadata and any indexed fields are added with
+// a splunk_ prefix so routes can match on them.
+func (s *HECServer) toEvent(text string, record map[string]interface{}, meta metadata, indexed map[string]interface{}, remote string) *buffer.Event {
+	fields := record
+	if fields == nil {
+		fields = map[string]interface{}{"message": text}
+	}
+
+	for key, value := range indexed {
+		fields["splunk_"+key] = value
+	}
+
+	if len(meta.Host) == 0 {
+		meta.Host = remote
+	}
+
+	set := func(key string, value string) {
+		if len(value) > 0 {
+			fields[key] = value
+		}
+	}
+	set("splunk_index", meta.Index)
+	set("splunk_sourcetype", meta.Sourcetype)
+	set("splunk_source", meta.Source)
+	set("splunk_host", meta.Host)
+
+	return &buffer.Event{
+		Source: fmt.Sprintf("splunk_hec://%s", meta.Host),
+		Text:   &text,
+		Fields: &fields,
+	}
+}
+
+func (s *HECServer) send(ev *buffer.Event) {
+	if server.RandInt(0, 100) < *s.config.SampleSize {
+		s.receiver.Send(ev)
+	}
+}
+
+// toTimestamp converts the epoch seconds of a HEC event to RFC 3339
+func toTimestamp(value interface{}) (string, bool) {
+	var number json.Number
+
+	switch v := value.(type) {
+	case json.Number:
+		number = v
+	case string:
+		number = json.Number(v)
+	default:
+		return "", false
+	}
+
+	seconds, err := number.Float64()
+	if err != nil {
+		return "", false
+	}
+
+	sec := int64(seconds)
+	nsec := int64((seconds - float64(sec)) * 1e9)
+	return time.Unix(sec, nsec).UTC().Format(time.RFC3339Nano), true
+}
+
+// handleEvent accepts one or more concatenated JSON event objects
+func (s *HECServer) handleEvent(w http.ResponseWriter, r *http.Request, remote string) {
+	reader, err := body(r)
+	if err != nil {
+		reply(w, http.StatusBadRequest, codeInvalidData, "Invalid data format")
+		return
+	}
+	defer reader.Close()
+
+	decoder := json.NewDecoder(io.LimitReader(reader, maxBodyLen))
+	decoder.UseNumber()
+
+	defaults := s.queryMetadata(r)
+	count := 0
+
+	for {
+		var e hecEvent
+		err := decoder.Decode(&e)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			reply(w, http.StatusBadRequest, codeInvalidData, "Invalid data format")
+			return
+		}
+
+		if e.Event == nil {
+			reply(w, http.StatusBadRequest, codeNoEvent, "Event field is required")
+			return
+		}
+
+		meta := metadata{Index: e.Index, Sourcetype: e.Sourcetype, Source: e.Source, Host: e.Host}
+		meta = merge(meta, defaults)
+
+		var text string
+		record, _ := e.Event.(map[string]interface{})
+		if str, ok := e.Event.(string); ok {
+			text = str
+		} else {
+			b, _ := json.Marshal(e.Event)
+			text = string(b)
+		}
+
+		ev := s.toEvent(text, record, meta, e.Fields, remote)
+		if ts, ok := toTimestamp(e.Time); ok {
+			if _, exists := (*ev.Fields)["timestamp"]; !exists {
+				(*ev.Fields)["timestamp"] = ts
+			}
+		}
+
+		s.send(ev)
+		count++
+	}
+
+	if count == 0 {
+		reply(w, http.StatusBadRequest, codeNoData, "No data")
+		return
+	}
+
+	reply(w, http.StatusOK, codeSuccess, "Success")
+}
+
+// handleRaw accepts newline-separated lines, with the metadata given in the
+// query string
+func (s *HECServer) handleRaw(w http.ResponseWriter, r *http.Request, remote string) {
+	reader, err := body(r)
+	if err != nil {
+		reply(w, http.StatusBadRequest, codeInvalidData, "Invalid data format")
+		return
+	}
+	defer reader.Close()
+
+	meta := s.queryMetadata(r)
+	scanner := bufio.NewScanner(io.LimitReader(reader, maxBodyLen))
+	scanner.Buffer(make([]byte, 64*1024), maxBodyLen)
+	count := 0
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) == 0 {
+			continue
+		}
+
+		s.send(s.toEvent(line, nil, meta, nil, remote))
+		count++
+	}
+
+	if err := scanner.Err(); err != nil {
+		reply(w, http.StatusBadRequest, codeInvalidData, "Invalid data format")
+		return
+	}
+
+	if count == 0 {
+		reply(w, http.StatusBadRequest, codeNoData, "No data")
+		return
+	}
+
+	reply(w, http.StatusOK, codeSuccess, "Success")
+}
+
+func (s *HECServer) queryMetadata(r *http.Request) metadata {
+	query := r.URL.Query()
+	return metadata{
+		Index:      query.Get("index"),
+		Sourcetype: query.Get("sourcetype"),
+		Source:     query.Get("source"),
+		Host:       query.Get("host"),
+	}
+}
+
+// merge fills the empty metadata of an event from the request defaults
+func merge(meta metadata, defaults metadata) metadata {
+	if len(meta.Index) == 0 {
+		meta.Index = defaults.Index
+	}
+	if len(meta.Sourcetype) == 0 {
+		meta.Sourcetype = defaults.Sourcetype
+	}
+	if len(meta.Source) == 0 {
+		meta.Source = defaults.Source
+	}
+	if len(meta.Host) == 0 {
+		meta.Host = defaults.Host
+	}
+	return meta
+}
+
+func (s *HECServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimSuffix(r.URL.Path, "/")
+
+	if path == "/services/collector/health" || path == "/services/collector/health/1.0" {
+		reply(w, http.StatusOK, codeHealthy, "HEC is healthy")
+		return
+	}
+
+	if r.Method != "POST" {
+		reply(w, http.StatusMethodNotAllowed, codeBadRequest, "Incorrect request method")
+		return
+	}
+
+	if ok, code := s.authorized(r); !ok {
+		text := "Token is required"
+		if code == codeInvalidToken {
+			text = "Invalid token"
+		}
+		reply(w, http.StatusUnauthorized, code, text)
+		return
+	}
+
+	remote, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	switch path {
+	case "/services/collector", "/services/collector/event", "/services/collector/event/1.0":
+		s.handleEvent(w, r, remote)
+	case "/services/collector/raw", "/services/collector/raw/1.0":
+		s.handleRaw(w, r, remote)
+	default:
+		log.Printf("[%s] Unknown HEC endpoint %s from %s", s.name, path, remote)
+		reply(w, http.StatusNotFound, codeBadRequest, "The requested URL was not found on this server.")
+	}
+}
@@ -0,0 +1,129 @@
+package splunkhec
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/packetzoom/logzoom/input"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	maxBodyLen         = 64 * 1024 * 1024 // 64 mb
+	defaultReadTimeout = 60
+)
+
+type Config struct {
+	Host        string   `yaml:"host"`
+	Tokens      []string `yaml:"tokens"`
+	SSLCrt      string   `yaml:"ssl_crt"`
+	SSLKey      string   `yaml:"ssl_key"`
+	ReadTimeout int      `yaml:"read_timeout"`
+	SampleSize  *int     `yaml:"sample_size,omitempty"`
+}
+
+type HECServer struct {
+	name     string
+	config   Config
+	receiver input.Receiver
+	server   *http.Server
+	term     chan bool
+}
+
+func init() {
+	input.Register("splunk_hec", New)
+}
+
+func New() input.Input {
+	return &HECServer{term: make(chan bool, 1)}
+}
+
+func (s *HECServer) ValidateConfig(config *Config) error {
+	if len(config.Host) == 0 {
+		return errors.New("Missing host")
+	}
+
+	if (len(config.SSLCrt) > 0) != (len(config.SSLKey) > 0) {
+		return errors.New("Both ssl_crt and ssl_key are required for TLS")
+	}
+
+	if len(config.Tokens) == 0 {
+		log.Printf("[%s] No tokens configured, accepting unauthenticated requests", s.name)
+	}
+
+	if s.config.ReadTimeout <= 0 {
+		s.config.ReadTimeout = defaultReadTimeout
+	}
+
+	if s.config.SampleSize == nil {
+		i := 100
+		s.config.SampleSize = &i
+	}
+	log.Printf("[%s] Setting Sample Size to %d", s.name, *s.config.SampleSize)
+
+	return nil
+}
+
+func (s *HECServer) Init(name string, config yaml.MapSlice, receiver input.Receiver) error {
+	var hecConfig *Config
+
+	// go-yaml doesn't have a great way to partially unmarshal YAML data
+	// See https://github.com/go-yaml/yaml/issues/13
+	yamlConfig, _ := yaml.Marshal(config)
+
+	if err := yaml.Unmarshal(yamlConfig, &hecConfig); err != nil {
+		return fmt.Errorf("Error parsing Splunk HEC config: %v", err)
+	}
+
+	s.name = name
+	s.config = *hecConfig
+	s.receiver = receiver
+
+	if err := s.ValidateConfig(hecConfig); err != nil {
+		return fmt.Errorf("Error in config: %v", err)
+	}
+
+	return nil
+}
+
+func (s *HECServer) Start() error {
+	ln, err := net.Listen("tcp", s.config.Host)
+	if err != nil {
+		return fmt.Errorf("Listener failed: %v", err)
+	}
+
+	if len(s.config.SSLCrt) > 0 {
+		cert, err := tls.LoadX509KeyPair(s.config.SSLCrt, s.config.SSLKey)
+		if err != nil {
+			return fmt.Errorf("Error loading keys: %v", err)
+		}
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+	}
+
+	s.server = &http.Server{
+		Handler:     s,
+		ReadTimeout: time.Duration(s.config.ReadTimeout) * time.Second,
+	}
+
+	go func() {
+		if err := s.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("[%s] Splunk HEC server error: %v", s.name, err)
+		}
+	}()
+
+	log.Printf("[%s] Started Splunk HEC Instance", s.name)
+
+	<-s.term
+	log.Println("Splunk HEC server received term signal")
+	return s.server.Close()
+}
+
+func (s *HECServer) Stop() error {
+	s.term <- true
+	return nil
+}
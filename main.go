@@ -6,11 +6,24 @@ import (
 	"log"
 	"os"
 
+	_ "github.com/packetzoom/logzoom/input/esbulk"
 	_ "github.com/packetzoom/logzoom/input/filebeat"
+	_ "github.com/packetzoom/logzoom/input/fluentforward"
+	_ "github.com/packetzoom/logzoom/input/gelf"
+	_ "github.com/packetzoom/logzoom/input/kafka"
 	_ "github.com/packetzoom/logzoom/input/redis"
+	_ "github.com/packetzoom/logzoom/input/splunkhec"
 	_ "github.com/packetzoom/logzoom/output/elasticsearch"
+	_ "github.com/packetzoom/logzoom/output/file"
+	_ "github.com/packetzoom/logzoom/output/gelf"
+	_ "github.com/packetzoom/logzoom/output/http"
+	_ "github.com/packetzoom/logzoom/output/kafka"
+	_ "github.com/packetzoom/logzoom/output/loki"
+	_ "github.com/packetzoom/logzoom/output/lumberjack"
 	_ "github.com/packetzoom/logzoom/output/redis"
 	_ "github.com/packetzoom/logzoom/output/s3"
+	_ "github.com/packetzoom/logzoom/output/splunkhec"
+	_ "github.com/packetzoom/logzoom/output/stdout"
 	_ "github.com/packetzoom/logzoom/output/tcp"
 	_ "github.com/packetzoom/logzoom/output/websocket"
 	"github.com/packetzoom/logzoom/server"
@@ -0,0 +1,197 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/olivere/elastic.v5"
+)
+
+const (
+	defaultMaxRetries = 5
+	maxRetryBackoff   = 60 * time.Second
+)
+
+// bulkStats counts the outcome of every bulk item sent by an output
+type bulkStats struct {
+	indexed      int64
+	duplicates   int64
+	retried      int64
+	deadLettered int64
+	dropped      int64
+}
+
+func (s *bulkStats) String() string {
+	return fmt.Sprintf("indexed=%d duplicates=%d retried=%d dead_lettered=%d dropped=%d",
+		atomic.LoadInt64(&s.indexed),
+		atomic.LoadInt64(&s.duplicates),
+		atomic.LoadInt64(&s.retried),
+		atomic.LoadInt64(&s.deadLettered),
+		atomic.LoadInt64(&s.dropped))
+}
+
+// bulkRetrier keeps track of the attempts made for each request, and of
+// the requests that are dead letters themselves
+type bulkRetrier struct {
+	sync.Mutex
+	attempts    map[elastic.BulkableRequest]int
+	deadLetters map[elastic.BulkableRequest]bool
+	file        *os.File
+}
+
+func newBulkRetrier() *bulkRetrier {
+	return &bulkRetrier{
+		attempts:    make(map[elastic.BulkableRequest]int),
+		deadLetters: make(map[elastic.BulkableRequest]bool),
+	}
+}
+
+// retryable reports whether an item failed for a reason that may go away
+func retryable(status int) bool {
+	return status == 429 || status >= 500
+}
+
+// retry adds a request back to the bulk processor after a backoff growing
+// with the number of attempts. It returns false once max_retries is reached.
+func (es *ESServer) retry(request elastic.BulkableRequest) bool {
+	es.retrier.Lock()
+	attempt := es.retrier.attempts[request]
+	if attempt >= *es.config.MaxRetries {
+		delete(es.retrier.attempts, request)
+		es.retrier.Unlock()
+		return false
+	}
+	es.retrier.attempts[request] = attempt + 1
+	es.retrier.Unlock()
+
+	backoff := time.Second << uint(attempt)
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+
+	atomic.AddInt64(&es.stats.retried, 1)
+	time.AfterFunc(backoff, func() {
+		es.idx.bulkProcessor.Add(request)
+	})
+
+	return true
+}
+
+// done forgets a request that needs no further attempts
+func (es *ESServer) done(request elastic.BulkableRequest) {
+	es.retrier.Lock()
+	delete(es.retrier.attempts, request)
+	delete(es.retrier.deadLetters, request)
+	es.retrier.Unlock()
+}
+
+// deadLetter records a document that Elasticsearch rejected, with the
+// reason, in the dead letter index or file. Without either it is dropped.
+func (es *ESServer) deadLetter(request elastic.BulkableRequest, item *elastic.BulkResponseItem, reason string) {
+	es.retrier.Lock()
+	isDeadLetter := es.retrier.deadLetters[request]
+	es.retrier.Unlock()
+
+	// A dead letter that fails again is not sent back to the dead letters
+	if isDeadLetter || (len(es.config.DeadLetterIndex) == 0 && len(es.config.DeadLetterFile) == 0) {
+		log.Printf("[%s] Dropping document for %s: %s", es.name, item.Index, reason)
+		atomic.AddInt64(&es.stats.dropped, 1)
+		return
+	}
+
+	var document string
+	if lines, err := request.Source(); err == nil && len(lines) > 1 {
+		document = lines[len(lines)-1]
+	}
+
+	entry := map[string]interface{}{
+		"@timestamp": time.Now().UTC().Format(time.RFC3339Nano),
+		"index":      item.Index,
+		"status":     item.Status,
+		"error":      reason,
+		"document":   document,
+	}
+
+	atomic.AddInt64(&es.stats.deadLettered, 1)
+
+	if len(es.config.DeadLetterFile) > 0 {
+		line, _ := json.Marshal(entry)
+
+		es.retrier.Lock()
+		_, err := es.retrier.file.Write(append(line, '\n'))
+		es.retrier.Unlock()
+
+		if err != nil {
+			log.Printf("[%s] Error writing dead letter: %v", es.name, err)
+		}
+		return
+	}
+
+	deadLetter := elastic.NewBulkIndexRequest().
+		Index(es.config.DeadLetterIndex).
+		Type(es.config.IndexType).
+		Doc(entry)
+
+	es.retrier.Lock()
+	es.retrier.deadLetters[deadLetter] = true
+	es.retrier.Unlock()
+
+	es.idx.bulkProcessor.Add(deadLetter)
+}
+
+func errorReason(item *elastic.BulkResponseItem) string {
+	if item.Error == nil {
+		return fmt.Sprintf("status %d", item.Status)
+	}
+	return fmt.Sprintf("%s: %s", item.Error.Type, item.Error.Reason)
+}
+
+// afterCommit inspects every item of a bulk response. Items rejected with
+// 429 or 5xx are retried with backoff; other rejections, such as mapping
+// conflicts, go to the dead letters. With op_type create, a 409 means the
+// document was already indexed.
+func (es *ESServer) afterCommit(id int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
+	if response == nil {
+		log.Printf("[%s] Error sending %d documents to Elasticsearch: %v", es.name, len(requests), err)
+		for _, request := range requests {
+			if !es.retry(request) {
+				atomic.AddInt64(&es.stats.dropped, 1)
+				es.done(request)
+			}
+		}
+		return
+	}
+
+	for i, items := range response.Items {
+		if i >= len(requests) {
+			break
+		}
+		request := requests[i]
+
+		for _, item := range items {
+			switch {
+			case item.Status >= 200 && item.Status < 300:
+				atomic.AddInt64(&es.stats.indexed, 1)
+			case item.Status == 409 && es.config.OpType == "create":
+				atomic.AddInt64(&es.stats.duplicates, 1)
+			case retryable(item.Status):
+				if es.retry(request) {
+					continue
+				}
+				es.deadLetter(request, item, errorReason(item))
+			default:
+				es.deadLetter(request, item, errorReason(item))
+			}
+			es.done(request)
+		}
+	}
+
+	if es.idx.RateCounter.Rate() > 0 {
+		log.Printf("[%s] Flushed events to Elasticsearch, current rate: %d/s, %s", es.name, es.idx.RateCounter.Rate(), &es.stats)
+	}
+}
@@ -0,0 +1,97 @@
+package elasticsearch
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/packetzoom/logzoom/server"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+// apiKeyTransport adds an Elasticsearch API key to every request
+type apiKeyTransport struct {
+	key  string
+	next http.RoundTripper
+}
+
+func (t *apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request they are given
+	clone := new(http.Request)
+	*clone = *req
+	clone.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		clone.Header[k] = v
+	}
+	clone.Header.Set("Authorization", "ApiKey "+t.key)
+
+	return t.next.RoundTrip(clone)
+}
+
+func (es *ESServer) tlsConfig() (*tls.Config, error) {
+	return server.ClientTLSConfig(es.config.SSLCA, es.config.SSLCrt, es.config.SSLKey, es.config.SSLInsecureSkipVerify)
+}
+
+// httpClient returns an HTTP client of its own for this output, so the
+// timeout, TLS settings and connection pool are not shared with others
+func (es *ESServer) httpClient() (*http.Client, error) {
+	tlsConfig, err := es.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var transport http.RoundTripper = &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConnsPerHost: es.config.Workers,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	if len(es.config.APIKey) > 0 {
+		transport = &apiKeyTransport{key: es.config.APIKey, next: transport}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(es.config.Timeout) * time.Second,
+	}, nil
+}
+
+func (es *ESServer) newClient(httpClient *http.Client) (*elastic.Client, error) {
+	var infoLogger, errorLogger *log.Logger
+
+	if es.config.InfoLogEnabled {
+		infoLogger = log.New(os.Stdout, "", log.LstdFlags)
+	} else {
+		infoLogger = log.New(new(DevNull), "", log.LstdFlags)
+	}
+
+	if es.config.ErrorLogEnabled {
+		errorLogger = log.New(os.Stderr, "", log.LstdFlags)
+	} else {
+		errorLogger = log.New(new(DevNull), "", log.LstdFlags)
+	}
+
+	options := []elastic.ClientOptionFunc{
+		elastic.SetURL(es.hosts...),
+		elastic.SetHttpClient(httpClient),
+		elastic.SetGzip(es.config.GzipEnabled),
+		elastic.SetSniff(*es.config.Sniff),
+		elastic.SetInfoLog(infoLogger),
+		elastic.SetErrorLog(errorLogger),
+	}
+
+	if *es.config.HealthCheckInterval > 0 {
+		options = append(options, elastic.SetHealthcheckInterval(time.Duration(*es.config.HealthCheckInterval)*time.Second))
+	} else {
+		options = append(options, elastic.SetHealthcheck(false))
+	}
+
+	if len(es.config.Username) > 0 {
+		options = append(options, elastic.SetBasicAuth(es.config.Username, es.config.Password))
+	}
+
+	return elastic.NewClient(options...)
+}
@@ -5,8 +5,9 @@ import (
 	"errors"
 	"fmt"
 	"log"
-	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"time"
 	"golang.org/x/net/context"
 
@@ -20,39 +21,79 @@ import (
 )
 
 const (
-	defaultHost        = "127.0.0.1"
 	defaultIndexPrefix = "logstash"
+	defaultIndexType   = "logs"
 	esFlushInterval    = 10
 	esRecvBuffer       = 10000
 	esSendBuffer       = 10000
 	esWorker           = 20
 	esBulkLimit        = 10000
+	esTimeout          = 60
+	esHealthCheck      = 60
 )
 
 type Indexer struct {
 	bulkProcessor     *elastic.BulkProcessor
-	indexPrefix       string
+	indexPattern      string
+	fallbackIndex     string
+	timestampField    string
 	indexType         string
+	opType            string
+	dataStream        bool
+	idField           string
+	idHash            bool
+	pipeline          string
 	RateCounter       *ratecounter.RateCounter
 	lastDisplayUpdate time.Time
 }
 
 type Config struct {
-	Hosts           []string `yaml:"hosts"`
-	IndexPrefix     string   `yaml:"index"`
-	IndexType       string   `yaml:"index_type"`
-	Timeout         int      `yaml:"timeout"`
-	GzipEnabled     bool     `yaml:"gzip_enabled"`
-	InfoLogEnabled  bool     `yaml:"info_log_enabled"`
-	ErrorLogEnabled bool     `yaml:"error_log_enabled"`
-	SampleSize      *int      `yaml:"sample_size,omitempty"`
+	Hosts                 []string `yaml:"hosts"`
+	IndexPrefix           string   `yaml:"index"`
+	IndexRollover         string   `yaml:"index_rollover"`
+	FallbackIndex         string   `yaml:"fallback_index"`
+	TimestampField        string   `yaml:"timestamp_field"`
+	IndexType             string   `yaml:"index_type"`
+	Version               string   `yaml:"version"`
+	DataStream            bool     `yaml:"data_stream"`
+	OpType                string   `yaml:"op_type"`
+	IDField               string   `yaml:"id_field"`
+	IDHash                bool     `yaml:"id_hash"`
+	MaxRetries            *int     `yaml:"max_retries,omitempty"`
+	DeadLetterIndex       string   `yaml:"dead_letter_index"`
+	DeadLetterFile        string   `yaml:"dead_letter_file"`
+	Timeout               int      `yaml:"timeout"`
+	Workers               int      `yaml:"workers"`
+	BulkActions           int      `yaml:"bulk_actions"`
+	BulkSize              int      `yaml:"bulk_size"`
+	FlushInterval         int      `yaml:"flush_interval"`
+	Username              string   `yaml:"username"`
+	Password              string   `yaml:"password"`
+	APIKey                string   `yaml:"api_key"`
+	SSLCA                 string   `yaml:"ssl_ca"`
+	SSLCrt                string   `yaml:"ssl_crt"`
+	SSLKey                string   `yaml:"ssl_key"`
+	SSLInsecureSkipVerify bool     `yaml:"ssl_insecure_skip_verify"`
+	Sniff                 *bool    `yaml:"sniff,omitempty"`
+	HealthCheckInterval   *int     `yaml:"health_check_interval,omitempty"`
+	GzipEnabled           bool     `yaml:"gzip_enabled"`
+	InfoLogEnabled        bool     `yaml:"info_log_enabled"`
+	ErrorLogEnabled       bool     `yaml:"error_log_enabled"`
+	SampleSize            *int     `yaml:"sample_size,omitempty"`
+	TemplateFile          string   `yaml:"template_file"`
+	TemplateOverwrite     bool     `yaml:"template_overwrite"`
+	Pipeline              string   `yaml:"pipeline"`
+	ILMPolicy             string   `yaml:"ilm_policy"`
+	ILMPolicyFile         string   `yaml:"ilm_policy_file"`
+	ILMRolloverAlias      string   `yaml:"ilm_rollover_alias"`
 }
 
 type ESServer struct {
-	name   string
-	fields map[string]string
-	config Config
-	host   string
+	name    string
+	config  Config
+	cluster cluster
+	stats   bulkStats
+	retrier *bulkRetrier
 	hosts  []string
 	b      buffer.Sender
 	term   chan bool
@@ -65,7 +106,6 @@ func init() {
 
 func New() (output.Output) {
 	return &ESServer{
-		host: fmt.Sprintf("%s:%d", defaultHost, time.Now().Unix()),
 		term: make(chan bool, 1),
 	}
 }
@@ -77,20 +117,48 @@ func (DevNull) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
-func indexName(idx string) string {
-	if len(idx) == 0 {
-		idx = defaultIndexPrefix
+// document returns the document to index. Data streams require a
+// @timestamp, which is added from the event time when missing.
+func (i *Indexer) document(ev *buffer.Event) interface{} {
+	if !i.dataStream {
+		return *ev.Text
 	}
 
-	return fmt.Sprintf("%s-%s", idx, time.Now().Format("2006.01.02"))
+	doc := make(map[string]interface{})
+	decoder := json.NewDecoder(strings.NewReader(*ev.Text))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&doc); err != nil {
+		doc = map[string]interface{}{"message": *ev.Text}
+	}
+
+	if _, ok := doc["@timestamp"]; !ok {
+		doc["@timestamp"] = eventTime(ev, i.timestampField).Format(time.RFC3339Nano)
+	}
+
+	return doc
 }
 
 func (i *Indexer) index(ev *buffer.Event) error {
-	doc := *ev.Text
-	idx := indexName(i.indexPrefix)
 	typ := i.indexType
 
-	request := elastic.NewBulkIndexRequest().Index(idx).Type(typ).Doc(doc)
+	idx, err := i.indexName(ev)
+	if err != nil {
+		return err
+	}
+
+	// The type is left out of typeless requests
+	request := elastic.NewBulkIndexRequest().Index(idx).Type(typ).OpType(i.opType).Doc(i.document(ev))
+	if id := i.documentID(ev); len(id) > 0 {
+		request.Id(id)
+	}
+
+	// Events missing a field the pipeline refers to are indexed without one
+	if len(i.pipeline) > 0 {
+		if pipeline, err := ev.Expand(i.pipeline); err == nil && len(pipeline) > 0 {
+			request.Pipeline(pipeline)
+		}
+	}
 	i.bulkProcessor.Add(request)
 	i.RateCounter.Incr(1)
 
@@ -102,12 +170,119 @@ func (e *ESServer) ValidateConfig(config *Config) error {
 		return errors.New("Missing hosts")
 	}
 
-	if len(config.IndexPrefix) == 0 {
+	if len(config.ILMPolicyFile) > 0 && len(config.ILMPolicy) == 0 {
+		return errors.New("ilm_policy_file requires ilm_policy to name the policy")
+	}
+
+	// Events are written to the rollover alias, and ILM names the indices
+	if len(config.ILMRolloverAlias) > 0 {
+		if len(config.ILMPolicy) == 0 {
+			return errors.New("ilm_rollover_alias requires ilm_policy")
+		}
+		if config.DataStream {
+			return errors.New("Data streams roll over without ilm_rollover_alias")
+		}
+		if len(config.IndexRollover) > 0 && config.IndexRollover != "none" {
+			return errors.New("index_rollover must be none with ilm_rollover_alias")
+		}
+		if len(config.IndexPrefix) > 0 && config.IndexPrefix != config.ILMRolloverAlias {
+			return errors.New("index must be left out or match ilm_rollover_alias")
+		}
+		e.config.IndexPrefix = config.ILMRolloverAlias
+		e.config.IndexRollover = "none"
+	}
+
+	if len(e.config.IndexPrefix) == 0 {
 		return errors.New("Missing index prefix (e.g. logstash)")
 	}
 
-	if len(config.IndexType) == 0 {
-		return errors.New("Missing index type (e.g. logstash)")
+	if len(e.config.Version) == 0 {
+		e.config.Version = versionAuto
+	}
+	if e.config.Version != versionAuto {
+		if _, err := parseVersion(e.config.Version); err != nil {
+			return err
+		}
+	}
+
+	switch e.config.OpType {
+	case "":
+		e.config.OpType = "index"
+		// Replays of a document with a known ID must not overwrite it
+		if config.DataStream || len(config.IDField) > 0 || config.IDHash {
+			e.config.OpType = "create"
+		}
+	case "index", "create":
+	default:
+		return fmt.Errorf("Unknown op_type %s (must be index or create)", config.OpType)
+	}
+
+	if config.DataStream && e.config.OpType != "create" {
+		return errors.New("Data streams only accept op_type create")
+	}
+
+	// Data streams roll over by themselves
+	if len(e.config.IndexRollover) == 0 {
+		e.config.IndexRollover = "daily"
+		if config.DataStream {
+			e.config.IndexRollover = "none"
+		}
+	}
+	if _, ok := rollovers[e.config.IndexRollover]; !ok {
+		return fmt.Errorf("Unknown index rollover %s (must be hourly, daily, weekly, monthly or none)", config.IndexRollover)
+	}
+
+	if len(e.config.TimestampField) == 0 {
+		e.config.TimestampField = defaultTimestampField
+	}
+
+	if e.config.MaxRetries == nil {
+		i := defaultMaxRetries
+		e.config.MaxRetries = &i
+	}
+
+	if len(config.DeadLetterIndex) > 0 && len(config.DeadLetterFile) > 0 {
+		return errors.New("Only one of dead_letter_index and dead_letter_file can be set")
+	}
+
+	if (len(config.SSLCrt) > 0) != (len(config.SSLKey) > 0) {
+		return errors.New("Both ssl_crt and ssl_key are required for a client certificate")
+	}
+
+	if len(config.APIKey) > 0 && len(config.Username) > 0 {
+		return errors.New("Only one of api_key and username can be set")
+	}
+
+	if e.config.Timeout <= 0 {
+		e.config.Timeout = esTimeout
+	}
+
+	if e.config.Workers <= 0 {
+		e.config.Workers = esWorker
+	}
+
+	if e.config.BulkActions <= 0 {
+		e.config.BulkActions = esBulkLimit
+	}
+
+	// No limit on the size of a bulk request unless set
+	if e.config.BulkSize <= 0 {
+		e.config.BulkSize = -1
+	}
+
+	if e.config.FlushInterval <= 0 {
+		e.config.FlushInterval = esFlushInterval
+	}
+
+	if e.config.Sniff == nil {
+		sniff := true
+		e.config.Sniff = &sniff
+	}
+
+	// 0 disables health checks
+	if e.config.HealthCheckInterval == nil {
+		i := esHealthCheck
+		e.config.HealthCheckInterval = &i
 	}
 
 	if e.config.SampleSize == nil {
@@ -131,15 +306,23 @@ func (e *ESServer) Init(name string, config yaml.MapSlice, b buffer.Sender, rout
 	}
 
 	e.name = name
-	e.fields = route.Fields
 	e.config = *esConfig
 	e.hosts = esConfig.Hosts
 	e.b = b
+	e.retrier = newBulkRetrier()
 
 	if err := e.ValidateConfig(esConfig); err != nil {
 		return fmt.Errorf("Error in config: %v", err)
 	}
 
+	if len(e.config.DeadLetterFile) > 0 {
+		file, err := os.OpenFile(e.config.DeadLetterFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return fmt.Errorf("Error opening dead letter file: %v", err)
+		}
+		e.retrier.file = file
+	}
+
 	return nil
 }
 
@@ -147,12 +330,153 @@ func readInputChannel(sampleSize int, idx *Indexer, receiveChan chan *buffer.Eve
 	select {
 		case ev := <-receiveChan:
 			if (server.RandInt(0, 100) < sampleSize) {
-				idx.index(ev)
+				if err := idx.index(ev); err != nil {
+					log.Printf("Dropping event for Elasticsearch: %v", err)
+				}
 			}
 	}
 }
 
+// templateIndexPattern returns the pattern of the indices the template
+// applies to: the indices behind the rollover alias with ILM, otherwise the
+// indices named by index
+func (es *ESServer) templateIndexPattern() string {
+	if len(es.config.ILMRolloverAlias) > 0 {
+		return es.config.ILMRolloverAlias + "-*"
+	}
+	return templatePattern(indexPattern(es.config.IndexPrefix, es.config.IndexRollover))
+}
+
+// addSettings adds index settings to a template, keeping the ones it sets
+func addSettings(template map[string]interface{}, settings map[string]interface{}) {
+	existing, ok := template["settings"].(map[string]interface{})
+	if !ok {
+		existing = make(map[string]interface{})
+		template["settings"] = existing
+	}
+
+	for key, value := range settings {
+		if _, ok := existing[key]; !ok {
+			existing[key] = value
+		}
+	}
+}
+
 func (es *ESServer) insertIndexTemplate(client *elastic.Client) error {
+	pattern := es.templateIndexPattern()
+
+	if len(es.config.TemplateFile) > 0 {
+		return es.insertTemplateFile(client, pattern)
+	}
+
+	if !es.cluster.typeless() && es.cluster.major < 6 {
+		return es.insertLegacyTemplate(client, pattern)
+	}
+
+	var mappings map[string]interface{}
+	if err := json.Unmarshal([]byte(TypelessMappings), &mappings); err != nil {
+		return err
+	}
+
+	settings := map[string]interface{}{"index.refresh_interval": "5s"}
+	for key, value := range es.lifecycleSettings() {
+		settings[key] = value
+	}
+
+	body := map[string]interface{}{
+		"index_patterns": []string{pattern},
+		"settings":       settings,
+		"mappings":       mappings,
+	}
+
+	switch {
+	case es.cluster.composableTemplates():
+		body = map[string]interface{}{
+			"index_patterns": []string{pattern},
+			// Above the built-in logs-*-* template of Elasticsearch 8
+			"priority": 200,
+			"template": map[string]interface{}{
+				"settings": settings,
+				"mappings": mappings,
+			},
+		}
+		if es.config.DataStream {
+			body["data_stream"] = map[string]interface{}{}
+		}
+	case !es.cluster.typeless():
+		body["mappings"] = map[string]interface{}{es.config.IndexType: mappings}
+	}
+
+	return es.putTemplate(client, templateName(pattern), body)
+}
+
+// insertTemplateFile installs the template read from template_file. The
+// file holds the body of the template API of the cluster; the index pattern,
+// data stream and ILM settings are filled in when it leaves them out.
+func (es *ESServer) insertTemplateFile(client *elastic.Client, pattern string) error {
+	body, err := readJSON(es.config.TemplateFile)
+	if err != nil {
+		return fmt.Errorf("Error reading template file: %v", err)
+	}
+
+	settings := es.lifecycleSettings()
+
+	switch {
+	case es.cluster.composableTemplates():
+		if _, ok := body["index_patterns"]; !ok {
+			body["index_patterns"] = []string{pattern}
+		}
+		if _, ok := body["data_stream"]; !ok && es.config.DataStream {
+			body["data_stream"] = map[string]interface{}{}
+		}
+		if len(settings) > 0 {
+			template, ok := body["template"].(map[string]interface{})
+			if !ok {
+				template = make(map[string]interface{})
+				body["template"] = template
+			}
+			addSettings(template, settings)
+		}
+	case es.cluster.major < 6 && !es.cluster.typeless():
+		if _, ok := body["template"]; !ok {
+			body["template"] = pattern
+		}
+	default:
+		if _, ok := body["index_patterns"]; !ok {
+			body["index_patterns"] = []string{pattern}
+		}
+		if len(settings) > 0 {
+			addSettings(body, settings)
+		}
+	}
+
+	return es.putTemplate(client, templateName(pattern), body)
+}
+
+// putTemplate installs a template with the template API of the cluster. An
+// existing template is kept unless template_overwrite is set.
+func (es *ESServer) putTemplate(client *elastic.Client, name string, body map[string]interface{}) error {
+	path := "/_template/" + name
+	if es.cluster.composableTemplates() {
+		path = "/_index_template/" + name
+	}
+
+	params := url.Values{}
+	if !es.config.TemplateOverwrite {
+		params.Set("create", "true")
+	}
+
+	response, err := client.PerformRequest(context.Background(), "PUT", path, params, body)
+
+	if response != nil {
+		log.Printf("Inserted template %s, response: %s", path, response.Body)
+	}
+
+	return err
+}
+
+// insertLegacyTemplate installs the template of Elasticsearch 5 and older
+func (es *ESServer) insertLegacyTemplate(client *elastic.Client, pattern string) error {
 	var template map[string]interface{}
 	err := json.Unmarshal([]byte(IndexTemplate), &template)
 
@@ -160,11 +484,11 @@ func (es *ESServer) insertIndexTemplate(client *elastic.Client) error {
 		return err
 	}
 
-	template["template"] = es.config.IndexPrefix + "-*"
+	template["template"] = pattern
 
 	inserter := elastic.NewIndicesPutTemplateService(client)
-	inserter.Name(es.config.IndexPrefix)
-	inserter.Create(true)
+	inserter.Name(templateName(pattern))
+	inserter.Create(!es.config.TemplateOverwrite)
 	inserter.BodyJson(template)
 
 	response, err := inserter.Do(context.Background())
@@ -176,10 +500,43 @@ func (es *ESServer) insertIndexTemplate(client *elastic.Client) error {
 	return err
 }
 
-func (es *ESServer) afterCommit(id int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
-	if (es.idx.RateCounter.Rate() > 0) {
-		log.Printf("Flushed events to Elasticsearch, current rate: %d/s", es.idx.RateCounter.Rate())
+// configureCluster detects the cluster version unless it is configured,
+// and checks the output settings against it
+func (es *ESServer) configureCluster(client *elastic.Client) error {
+	var err error
+
+	if es.config.Version == versionAuto {
+		for {
+			es.cluster, err = detectCluster(client)
+			if err == nil {
+				break
+			}
+			log.Printf("[%s] Error detecting Elasticsearch version: %s, will retry", es.name, err)
+			time.Sleep(2 * time.Second)
+		}
+	} else if es.cluster, err = parseVersion(es.config.Version); err != nil {
+		return err
 	}
+
+	log.Printf("[%s] Using %s", es.name, es.cluster)
+
+	// A mismatch is not fixed by retrying
+	if es.config.DataStream && !es.cluster.composableTemplates() {
+		return fmt.Errorf("data streams require Elasticsearch 7.8 or later, or OpenSearch, found %s", es.cluster)
+	}
+
+	if len(es.config.ILMPolicy) > 0 && !es.cluster.lifecycles() {
+		return fmt.Errorf("ILM policies require Elasticsearch 6.6 or later, found %s", es.cluster)
+	}
+
+	if es.cluster.typeless() {
+		es.config.IndexType = ""
+	} else if len(es.config.IndexType) == 0 {
+		log.Printf("[%s] Setting index type to %s", es.name, defaultIndexType)
+		es.config.IndexType = defaultIndexType
+	}
+
+	return nil
 }
 
 func (es *ESServer) Start() error {
@@ -188,48 +545,40 @@ func (es *ESServer) Start() error {
 		return nil
 	}
 	var client *elastic.Client
-	var err error
 
-	for {
-		httpClient := http.DefaultClient
-		timeout := 60 * time.Second
-
-		if es.config.Timeout > 0 {
-			timeout = time.Duration(es.config.Timeout) * time.Second
-		}
+	log.Printf("[%s] Setting HTTP timeout to %ds", es.name, es.config.Timeout)
+	log.Printf("[%s] Setting GZIP enabled: %v", es.name, es.config.GzipEnabled)
 
-		log.Printf("[%s] Setting HTTP timeout to %v", es.name, timeout)
-		log.Printf("[%s] Setting GZIP enabled: %v", es.name, es.config.GzipEnabled)
-
-		httpClient.Timeout = timeout
+	httpClient, err := es.httpClient()
+	if err != nil {
+		return fmt.Errorf("Error in Elasticsearch config: %v", err)
+	}
 
-		var infoLogger, errorLogger *log.Logger
+	for {
+		client, err = es.newClient(httpClient)
 
-		if es.config.InfoLogEnabled {
-			infoLogger = log.New(os.Stdout, "", log.LstdFlags)
-		} else {
-			infoLogger = log.New(new(DevNull), "", log.LstdFlags)
+		if err != nil {
+			log.Printf("Error starting Elasticsearch: %s, will retry", err)
+			time.Sleep(2 * time.Second)
+			continue
 		}
 
-		if es.config.ErrorLogEnabled {
-			errorLogger = log.New(os.Stderr, "", log.LstdFlags)
-		} else {
-			errorLogger = log.New(new(DevNull), "", log.LstdFlags)
+		if err = es.configureCluster(client); err != nil {
+			return fmt.Errorf("Error in Elasticsearch config: %v", err)
 		}
 
-		client, err = elastic.NewClient(elastic.SetURL(es.hosts...),
-			elastic.SetHttpClient(httpClient),
-			elastic.SetGzip(es.config.GzipEnabled),
-			elastic.SetInfoLog(infoLogger),
-			elastic.SetErrorLog(errorLogger))
+		if err := es.insertLifecyclePolicy(client); err != nil {
+			log.Printf("[%s] Error inserting ILM policy: %v", es.name, err)
+		}
 
-		if err != nil {
-			log.Printf("Error starting Elasticsearch: %s, will retry", err)
-			time.Sleep(2 * time.Second)
-			continue
+		if err := es.insertIndexTemplate(client); err != nil {
+			log.Printf("[%s] Error inserting index template: %v", es.name, err)
 		}
 
-		es.insertIndexTemplate(client)
+		// After the template, so the first index gets its settings
+		if err := es.bootstrapRolloverAlias(client); err != nil {
+			log.Printf("[%s] Error bootstrapping rollover alias: %v", es.name, err)
+		}
 
 		break
 	}
@@ -238,18 +587,20 @@ func (es *ESServer) Start() error {
 
 	// Add the client as a subscriber
 	receiveChan := make(chan *buffer.Event, esRecvBuffer)
-	es.b.AddSubscriber(es.host, receiveChan)
-	defer es.b.DelSubscriber(es.host)
+	es.b.AddSubscriber(es.name, receiveChan)
+	defer es.b.DelSubscriber(es.name)
 
 	rateCounter := ratecounter.NewRateCounter(1 * time.Second)
 
+	flushInterval := time.Duration(es.config.FlushInterval) * time.Second
+
 	// Create bulk processor
         bulkProcessor, err := client.BulkProcessor().
 		After(es.afterCommit).                        // Function to call after commit
-		Workers(esWorker).                            // # of workers
-		BulkActions(esBulkLimit).                     // # of queued requests before committed
-		BulkSize(-1).                                 // No limit
-		FlushInterval(esFlushInterval * time.Second). // autocommit every # seconds
+		Workers(es.config.Workers).                   // # of workers
+		BulkActions(es.config.BulkActions).           // # of queued requests before committed
+		BulkSize(es.config.BulkSize).                 // # of bytes before committed
+		FlushInterval(flushInterval).                 // autocommit every # seconds
 		Stats(true).                                  // gather statistics
 		Do(context.Background())
 
@@ -257,7 +608,18 @@ func (es *ESServer) Start() error {
             log.Println(err)
         }
 
-	idx := &Indexer{bulkProcessor, es.config.IndexPrefix, es.config.IndexType, rateCounter, time.Now()}
+	idx := &Indexer{bulkProcessor,
+		indexPattern(es.config.IndexPrefix, es.config.IndexRollover),
+		es.config.FallbackIndex,
+		es.config.TimestampField,
+		es.config.IndexType,
+		es.config.OpType,
+		es.config.DataStream,
+		es.config.IDField,
+		es.config.IDHash,
+		es.config.Pipeline,
+		rateCounter,
+		time.Now()}
 	es.idx = idx
 
 	for {
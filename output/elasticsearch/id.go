@@ -0,0 +1,47 @@
+package elasticsearch
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/packetzoom/logzoom/buffer"
+)
+
+// hashID derives a stable document ID from where the event was read and
+// what it contains, so the same line delivered twice gets the same _id
+func hashID(ev *buffer.Event) string {
+	h := sha1.New()
+	h.Write([]byte(ev.Source))
+	h.Write([]byte{0})
+
+	var offset [8]byte
+	binary.BigEndian.PutUint64(offset[:], uint64(ev.Offset))
+	h.Write(offset[:])
+
+	if ev.Text != nil {
+		h.Write([]byte(*ev.Text))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// documentID returns the _id to index the event with: the value of
+// id_field when the event has it, otherwise the hash when id_hash is set.
+// An empty ID lets Elasticsearch generate one.
+func (i *Indexer) documentID(ev *buffer.Event) string {
+	if len(i.idField) > 0 && ev.Fields != nil {
+		if value, ok := (*ev.Fields)[i.idField]; ok && value != nil {
+			if id := fmt.Sprint(value); len(id) > 0 {
+				return id
+			}
+		}
+	}
+
+	if i.idHash {
+		return hashID(ev)
+	}
+
+	return ""
+}
@@ -0,0 +1,102 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+
+	"golang.org/x/net/context"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+// readJSON reads a JSON object from a file
+func readJSON(path string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal(data, &body); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %v", path, err)
+	}
+
+	return body, nil
+}
+
+// lifecycleSettings returns the index settings that attach new indices to
+// the ILM policy and rollover alias
+func (es *ESServer) lifecycleSettings() map[string]interface{} {
+	settings := make(map[string]interface{})
+
+	if len(es.config.ILMPolicy) > 0 {
+		settings["index.lifecycle.name"] = es.config.ILMPolicy
+	}
+	if len(es.config.ILMRolloverAlias) > 0 {
+		settings["index.lifecycle.rollover_alias"] = es.config.ILMRolloverAlias
+	}
+
+	return settings
+}
+
+// insertLifecyclePolicy installs the ILM policy from ilm_policy_file. Without
+// the file the policy is expected to exist already.
+func (es *ESServer) insertLifecyclePolicy(client *elastic.Client) error {
+	if len(es.config.ILMPolicyFile) == 0 {
+		return nil
+	}
+
+	body, err := readJSON(es.config.ILMPolicyFile)
+	if err != nil {
+		return err
+	}
+
+	// Accept the policy with or without the enclosing "policy" key
+	if _, ok := body["policy"]; !ok {
+		body = map[string]interface{}{"policy": body}
+	}
+
+	path := "/_ilm/policy/" + url.PathEscape(es.config.ILMPolicy)
+	response, err := client.PerformRequest(context.Background(), "PUT", path, nil, body)
+
+	if response != nil {
+		log.Printf("[%s] Inserted ILM policy %s, response: %s", es.name, es.config.ILMPolicy, response.Body)
+	}
+
+	return err
+}
+
+// bootstrapRolloverAlias creates the first index behind the rollover alias,
+// e.g. logs-000001, unless the alias exists. Events are then written to the
+// alias and ILM rolls the index over.
+func (es *ESServer) bootstrapRolloverAlias(client *elastic.Client) error {
+	alias := es.config.ILMRolloverAlias
+	if len(alias) == 0 {
+		return nil
+	}
+
+	response, err := client.PerformRequest(context.Background(), "HEAD", "/_alias/"+url.PathEscape(alias), nil, nil)
+	if err == nil && response.StatusCode == 200 {
+		return nil
+	}
+	if err != nil && !elastic.IsNotFound(err) {
+		return err
+	}
+
+	index := url.PathEscape(fmt.Sprintf("<%s-{now/d}-000001>", alias))
+	body := map[string]interface{}{
+		"aliases": map[string]interface{}{
+			alias: map[string]interface{}{"is_write_index": true},
+		},
+	}
+
+	response, err = client.PerformRequest(context.Background(), "PUT", "/"+index, nil, body)
+
+	if response != nil {
+		log.Printf("[%s] Bootstrapped rollover alias %s, response: %s", es.name, alias, response.Body)
+	}
+
+	return err
+}
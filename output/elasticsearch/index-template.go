@@ -97,3 +97,41 @@ const IndexTemplate string = `
   }
 }
 `
+
+// TypelessMappings are used from Elasticsearch 6 onwards and on
+// OpenSearch, which reject _default_, _all and not_analyzed
+const TypelessMappings string = `
+{
+  "dynamic_templates" : [ {
+    "message_field" : {
+      "match" : "message",
+      "match_mapping_type" : "string",
+      "mapping" : { "type" : "text", "norms" : false }
+    }
+  }, {
+    "string_fields" : {
+      "match" : "*",
+      "match_mapping_type" : "string",
+      "mapping" : {
+        "type" : "text", "norms" : false,
+        "fields" : {
+          "raw" : { "type" : "keyword", "ignore_above" : 256 }
+        }
+      }
+    }
+  } ],
+  "properties" : {
+    "@timestamp": { "type": "date" },
+    "@version": { "type": "keyword" },
+    "geoip"  : {
+      "dynamic": true,
+      "properties" : {
+        "ip": { "type": "ip" },
+        "location" : { "type" : "geo_point" },
+        "latitude" : { "type" : "half_float" },
+        "longitude" : { "type" : "half_float" }
+      }
+    }
+  }
+}
+`
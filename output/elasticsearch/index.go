@@ -0,0 +1,136 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/packetzoom/logzoom/buffer"
+)
+
+const (
+	defaultTimestampField = "timestamp"
+	maxIndexNameLen       = 255
+)
+
+// Date suffixes appended to an index without field or time references
+var rollovers = map[string]string{
+	"hourly":  "%{+2006.01.02.15}",
+	"daily":   "%{+2006.01.02}",
+	"weekly":  "%{+week}",
+	"monthly": "%{+2006.01}",
+	"none":    "",
+}
+
+// Characters Elasticsearch does not allow in index names
+var illegalIndexChars = strings.NewReplacer(
+	`\`, "_", "/", "_", "*", "_", "?", "_", `"`, "_", "<", "_",
+	">", "_", "|", "_", " ", "_", ",", "_", "#", "_", ":", "_",
+)
+
+// indexPattern returns the index template of the output. A plain index
+// name is treated as a prefix and gets the rollover date appended.
+func indexPattern(index string, rollover string) string {
+	if buffer.HasFieldReferences(index) {
+		return index
+	}
+
+	suffix := rollovers[rollover]
+	if len(suffix) == 0 {
+		return index
+	}
+
+	return index + "-" + suffix
+}
+
+// templatePattern returns the wildcard pattern matching every index the
+// output can write to, e.g. "logs-*" for "logs-%{service}-%{+2006.01}"
+func templatePattern(pattern string) string {
+	if i := strings.Index(pattern, "%{"); i >= 0 {
+		return sanitizeIndex(pattern[:i]) + "*"
+	}
+	return sanitizeIndex(pattern)
+}
+
+// templateName names the index template after the static part of the
+// index pattern
+func templateName(pattern string) string {
+	name := strings.Trim(strings.TrimSuffix(pattern, "*"), "-_.")
+	if len(name) == 0 {
+		return defaultIndexPrefix
+	}
+	return name
+}
+
+// sanitizeIndex lowercases an index name and replaces the characters
+// Elasticsearch rejects
+func sanitizeIndex(name string) string {
+	name = illegalIndexChars.Replace(strings.ToLower(name))
+	name = strings.TrimLeft(name, "-_+")
+
+	if name == "." || name == ".." {
+		name = ""
+	}
+
+	if len(name) > maxIndexNameLen {
+		name = name[:maxIndexNameLen]
+	}
+
+	return name
+}
+
+// eventTime returns the time of an event from its timestamp field, so
+// events are indexed by when they happened rather than when they arrived
+func eventTime(ev *buffer.Event, field string) time.Time {
+	if value, ok := ev.FieldString(field); ok {
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.000Z0700"} {
+			if t, err := time.Parse(layout, value); err == nil {
+				return t.UTC()
+			}
+		}
+	}
+
+	return time.Now().UTC()
+}
+
+// expandIndex resolves an index template for an event. %{field} is
+// replaced by the field value and %{+layout} by the event time formatted
+// with a Go time layout; %{+week} gives the ISO week, e.g. 2016.w14.
+func expandIndex(pattern string, ev *buffer.Event, t time.Time) (string, error) {
+	name, err := buffer.ExpandFields(pattern, func(key string) (string, bool) {
+		if !strings.HasPrefix(key, "+") {
+			return ev.FieldString(key)
+		}
+
+		if key == "+week" {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d.w%02d", year, week), true
+		}
+
+		return t.Format(key[1:]), true
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	name = sanitizeIndex(name)
+	if len(name) == 0 {
+		return "", fmt.Errorf("index %q resolves to an empty name", pattern)
+	}
+
+	return name, nil
+}
+
+// indexName returns the index for an event, or the fallback index when the
+// event lacks a field the index refers to
+func (i *Indexer) indexName(ev *buffer.Event) (string, error) {
+	t := eventTime(ev, i.timestampField)
+
+	name, err := expandIndex(i.indexPattern, ev, t)
+	if err != nil && len(i.fallbackIndex) > 0 {
+		return expandIndex(i.fallbackIndex, ev, t)
+	}
+
+	return name, err
+}
@@ -0,0 +1,99 @@
+package elasticsearch
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"gopkg.in/olivere/elastic.v5"
+)
+
+const (
+	versionAuto       = "auto"
+	distOpenSearch    = "opensearch"
+	distElasticsearch = "elasticsearch"
+)
+
+// cluster describes the flavour of the cluster, which decides whether
+// mapping types are used and which template API is available
+type cluster struct {
+	distribution string
+	major        int
+	minor        int
+}
+
+func (c cluster) String() string {
+	return fmt.Sprintf("%s %d.%d", c.distribution, c.major, c.minor)
+}
+
+// typeless reports whether bulk requests must not carry a mapping type
+func (c cluster) typeless() bool {
+	return c.distribution == distOpenSearch || c.major >= 7
+}
+
+// composableTemplates reports whether the _index_template API, needed for
+// data streams, is available
+func (c cluster) composableTemplates() bool {
+	return c.distribution == distOpenSearch || c.major > 7 || (c.major == 7 && c.minor >= 8)
+}
+
+// lifecycles reports whether index lifecycle management is available.
+// OpenSearch has its own state management plugin instead.
+func (c cluster) lifecycles() bool {
+	return c.distribution == distElasticsearch && (c.major > 6 || (c.major == 6 && c.minor >= 6))
+}
+
+// parseVersion reads the version setting, e.g. "6", "7.10" or "opensearch"
+func parseVersion(version string) (cluster, error) {
+	if version == distOpenSearch {
+		return cluster{distribution: distOpenSearch, major: 1}, nil
+	}
+
+	c := cluster{distribution: distElasticsearch}
+	parts := strings.SplitN(version, ".", 3)
+
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return c, fmt.Errorf("Unknown version %s (must be auto, opensearch or a version number)", version)
+	}
+	c.major = major
+
+	if len(parts) > 1 {
+		c.minor, _ = strconv.Atoi(parts[1])
+	}
+
+	return c, nil
+}
+
+// detectCluster asks the cluster for its version. OpenSearch reports its
+// own version number along with the distribution.
+func detectCluster(client *elastic.Client) (cluster, error) {
+	res, err := client.PerformRequest(context.Background(), "GET", "/", nil, nil)
+	if err != nil {
+		return cluster{}, err
+	}
+
+	var info struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+
+	if err := json.Unmarshal(res.Body, &info); err != nil {
+		return cluster{}, err
+	}
+
+	c, err := parseVersion(info.Version.Number)
+	if err != nil {
+		return c, err
+	}
+
+	if info.Version.Distribution == distOpenSearch {
+		c.distribution = distOpenSearch
+	}
+
+	return c, nil
+}
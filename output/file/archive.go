@@ -0,0 +1,146 @@
+package file
+
+import (
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/packetzoom/logzoom/buffer"
+)
+
+// Matches strftime directives, but not %{field} references
+var timeDirective = regexp.MustCompile(`%[^{%]`)
+
+var compressionSuffixes = map[string]string{
+	compressionNone: "",
+	compressionGzip: ".gz",
+	compressionZstd: ".zst",
+}
+
+// retentionGlob turns a path template into a glob matching every file
+// written for the same field values: time directives become wildcards, and
+// a trailing wildcard covers rotated and compressed files
+func retentionGlob(template string, ev *buffer.Event) (string, error) {
+	glob := timeDirective.ReplaceAllString(template, "*")
+
+	glob, err := buffer.ExpandFields(glob, func(key string) (string, bool) {
+		value, ok := pathField(ev, key)
+		return escapeGlob(value), ok
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return glob + "*", nil
+}
+
+func escapeGlob(value string) string {
+	replacer := strings.NewReplacer(`*`, `\*`, `?`, `\?`, `[`, `\[`, `\`, `\\`)
+	return replacer.Replace(value)
+}
+
+// compress replaces a closed file with its compressed copy
+func compress(path string, compression string) error {
+	if compression == compressionNone {
+		return nil
+	}
+
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// A file closed and reopened under the same path, e.g. after being
+	// idle, must not overwrite the archive of its previous contents
+	suffix := compressionSuffixes[compression]
+	dest := path + suffix
+	if _, err := os.Stat(dest); err == nil {
+		dest = rotatedName(path, suffix) + suffix
+	}
+
+	tmp := dest + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	var w io.WriteCloser
+	if compression == compressionGzip {
+		w = gzip.NewWriter(out)
+	} else {
+		if w, err = zstd.NewWriter(out); err != nil {
+			out.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+
+	_, err = io.Copy(w, in)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	out.Close()
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, dest); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// prune removes the oldest closed files matching the glob beyond the
+// retention count. Open files and files being compressed are kept.
+func prune(glob string, retention int, open map[string]bool) {
+	matches, err := filepath.Glob(glob)
+	if err != nil {
+		log.Printf("Error listing %s: %v", glob, err)
+		return
+	}
+
+	type closedFile struct {
+		path    string
+		modTime int64
+	}
+
+	files := make([]closedFile, 0, len(matches))
+	for _, path := range matches {
+		if open[path] || strings.HasSuffix(path, ".tmp") {
+			continue
+		}
+
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		files = append(files, closedFile{path, info.ModTime().UnixNano()})
+	}
+
+	if len(files) <= retention {
+		return
+	}
+
+	// Newest first
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime > files[j].modTime })
+
+	for _, f := range files[retention:] {
+		if err := os.Remove(f.path); err != nil {
+			log.Printf("Error removing %s: %v", f.path, err)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package file
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jehiah/go-strftime"
+	"github.com/packetzoom/logzoom/buffer"
+	"github.com/packetzoom/logzoom/output"
+	"github.com/packetzoom/logzoom/route"
+	"github.com/packetzoom/logzoom/server"
+	"github.com/paulbellamy/ratecounter"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	recvBuffer           = 10000
+	rateDisplayInterval  = 10
+	flushInterval        = 1
+	defaultMaxOpenFiles  = 100
+	defaultIdleTimeout   = 300
+	defaultFsyncInterval = 1
+	archiveBuffer        = 100
+
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+
+	fsyncNever    = "never"
+	fsyncInterval = "interval"
+	fsyncAlways   = "always"
+)
+
+type Config struct {
+	Path          string `yaml:"path"`
+	FallbackPath  string `yaml:"fallback_path"`
+	Format        string `yaml:"format"`
+	MaxSize       int64  `yaml:"max_size"`
+	MaxAge        int    `yaml:"max_age"`
+	Compression   string `yaml:"compression"`
+	Retention     int    `yaml:"retention"`
+	Fsync         string `yaml:"fsync"`
+	FsyncInterval int    `yaml:"fsync_interval"`
+	MaxOpenFiles  int    `yaml:"max_open_files"`
+	IdleTimeout   int    `yaml:"idle_timeout"`
+	SampleSize    *int   `yaml:"sample_size,omitempty"`
+}
+
+// closedFile is handed to the archiver to be compressed and pruned
+type closedFile struct {
+	path string
+	glob string
+}
+
+type FileServer struct {
+	name     string
+	config   Config
+	sender   buffer.Sender
+	files    map[string]*logFile
+	open     map[string]bool
+	openLock sync.Mutex
+	archive  chan closedFile
+	term     chan bool
+}
+
+func init() {
+	output.Register("file", New)
+}
+
+func New() output.Output {
+	return &FileServer{term: make(chan bool, 1)}
+}
+
+func (f *FileServer) ValidateConfig(config *Config) error {
+	if len(config.Path) == 0 {
+		return errors.New("Missing path")
+	}
+
+	switch f.config.Format {
+	case "":
+		f.config.Format = "text"
+	case "text", "json":
+	default:
+		return fmt.Errorf("Unknown format %s (must be text or json)", config.Format)
+	}
+
+	switch f.config.Compression {
+	case "":
+		f.config.Compression = compressionNone
+	case compressionNone, compressionGzip, compressionZstd:
+	default:
+		return fmt.Errorf("Unknown compression %s (must be none, gzip or zstd)", config.Compression)
+	}
+
+	switch f.config.Fsync {
+	case "":
+		f.config.Fsync = fsyncInterval
+	case fsyncNever, fsyncInterval, fsyncAlways:
+	default:
+		return fmt.Errorf("Unknown fsync policy %s (must be never, interval or always)", config.Fsync)
+	}
+
+	if f.config.FsyncInterval <= 0 {
+		f.config.FsyncInterval = defaultFsyncInterval
+	}
+
+	if f.config.MaxOpenFiles <= 0 {
+		f.config.MaxOpenFiles = defaultMaxOpenFiles
+	}
+
+	if f.config.IdleTimeout <= 0 {
+		f.config.IdleTimeout = defaultIdleTimeout
+	}
+
+	if f.config.SampleSize == nil {
+		i := 100
+		f.config.SampleSize = &i
+	}
+	log.Printf("[%s] Setting Sample Size to %d", f.name, *f.config.SampleSize)
+
+	return nil
+}
+
+func (f *FileServer) Init(name string, config yaml.MapSlice, sender buffer.Sender, route route.Route) error {
+	var fileConfig *Config
+
+	// go-yaml doesn't have a great way to partially unmarshal YAML data
+	// See https://github.com/go-yaml/yaml/issues/13
+	yamlConfig, _ := yaml.Marshal(config)
+
+	if err := yaml.Unmarshal(yamlConfig, &fileConfig); err != nil {
+		return fmt.Errorf("Error parsing file config: %v", err)
+	}
+
+	f.name = name
+	f.config = *fileConfig
+	f.sender = sender
+
+	if err := f.ValidateConfig(fileConfig); err != nil {
+		return fmt.Errorf("Error in config: %v", err)
+	}
+
+	return nil
+}
+
+func (f *FileServer) format(ev *buffer.Event) ([]byte, error) {
+	if f.config.Format == "json" {
+		line, err := json.Marshal(map[string]interface{}{
+			"source": ev.Source,
+			"offset": ev.Offset,
+			"text":   ev.Text,
+			"fields": ev.Fields,
+		})
+		return append(line, '\n'), err
+	}
+
+	return []byte(*ev.Text + "\n"), nil
+}
+
+// resolve returns the path of an event and the retention glob of that path.
+// Time directives are expanded first, so field values are never
+// interpreted as directives.
+func (f *FileServer) resolve(ev *buffer.Event) (string, string, error) {
+	template := f.config.Path
+	path, err := expandPath(template, ev)
+
+	if err != nil {
+		if len(f.config.FallbackPath) == 0 {
+			return "", "", err
+		}
+		template = f.config.FallbackPath
+		path = strftime.Format(template, time.Now())
+	}
+
+	glob, _ := retentionGlob(template, ev)
+	return path, glob, nil
+}
+
+// expandPath resolves the time directives and field references of a path
+// template. Field values can't add or leave directories: separators and NUL
+// are replaced, "." and ".." are rejected, and the cleaned path must stay
+// within the directory the template starts with.
+func expandPath(template string, ev *buffer.Event) (string, error) {
+	var invalid string
+
+	path, err := buffer.ExpandFields(strftime.Format(template, time.Now()), func(key string) (string, bool) {
+		value, ok := pathField(ev, key)
+		if ok && (value == "." || value == "..") && len(invalid) == 0 {
+			invalid = key
+		}
+		return value, ok
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if len(invalid) > 0 {
+		return "", fmt.Errorf("field %s is not a valid path element", invalid)
+	}
+
+	path = filepath.Clean(path)
+	dir := staticDir(template)
+
+	if rel, err := filepath.Rel(dir, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %s is outside %s", path, dir)
+	}
+
+	return path, nil
+}
+
+// Replaces the characters of field values that would change the directory
+// of a file
+var pathReplacer = strings.NewReplacer("/", "_", `\`, "_", "\x00", "_")
+
+// pathField returns the value of an event field for use in a file path
+func pathField(ev *buffer.Event, key string) (string, bool) {
+	value, ok := ev.FieldString(key)
+	return pathReplacer.Replace(value), ok
+}
+
+// staticDir returns the directory of the path template before its first
+// time directive or field reference
+func staticDir(template string) string {
+	if i := strings.Index(template, "%"); i >= 0 {
+		template = template[:i]
+	}
+	return filepath.Clean(filepath.Dir(template))
+}
+
+func (f *FileServer) setOpen(path string, open bool) {
+	f.openLock.Lock()
+	defer f.openLock.Unlock()
+
+	if open {
+		f.open[path] = true
+	} else {
+		delete(f.open, path)
+	}
+}
+
+func (f *FileServer) isOpen() map[string]bool {
+	f.openLock.Lock()
+	defer f.openLock.Unlock()
+
+	open := make(map[string]bool, len(f.open))
+	for path := range f.open {
+		open[path] = true
+	}
+	return open
+}
+
+// archiver compresses closed files and applies the retention count
+func (f *FileServer) archiver() {
+	for closed := range f.archive {
+		if err := compress(closed.path, f.config.Compression); err != nil {
+			log.Printf("[%s] Error compressing %s: %v", f.name, closed.path, err)
+		}
+
+		if f.config.Retention > 0 && len(closed.glob) > 0 {
+			prune(closed.glob, f.config.Retention, f.isOpen())
+		}
+	}
+}
+
+// closeFile closes a file and hands it to the archiver. Rotated files are
+// renamed first, so writing can resume under the same path.
+func (f *FileServer) closeFile(lf *logFile, rotate bool) {
+	delete(f.files, lf.path)
+	f.setOpen(lf.path, false)
+
+	if err := lf.close(); err != nil {
+		log.Printf("[%s] Error closing %s: %v", f.name, lf.path, err)
+	}
+
+	// A file that will be compressed gets a name of its own first, as new
+	// events for its path may reopen it before the archiver removes it
+	path := lf.path
+	if rotate || f.config.Compression != compressionNone {
+		path = rotatedName(lf.path, "")
+		if err := os.Rename(lf.path, path); err != nil {
+			log.Printf("[%s] Error rotating %s: %v", f.name, lf.path, err)
+			return
+		}
+	}
+
+	f.archive <- closedFile{path: path, glob: lf.glob}
+}
+
+// file returns the open file for a path, closing the least recently
+// written file when max_open_files would be exceeded
+func (f *FileServer) file(path string, glob string) (*logFile, error) {
+	if lf, ok := f.files[path]; ok {
+		return lf, nil
+	}
+
+	if len(f.files) >= f.config.MaxOpenFiles {
+		var oldest *logFile
+		for _, lf := range f.files {
+			if oldest == nil || lf.lastWrite.Before(oldest.lastWrite) {
+				oldest = lf
+			}
+		}
+		f.closeFile(oldest, false)
+	}
+
+	lf, err := openLogFile(path, glob)
+	if err != nil {
+		return nil, err
+	}
+
+	f.files[path] = lf
+	f.setOpen(path, true)
+	return lf, nil
+}
+
+func (f *FileServer) write(ev *buffer.Event) error {
+	path, glob, err := f.resolve(ev)
+	if err != nil {
+		return err
+	}
+
+	line, err := f.format(ev)
+	if err != nil {
+		return err
+	}
+
+	lf, err := f.file(path, glob)
+	if err != nil {
+		return err
+	}
+
+	if err := lf.write(line); err != nil {
+		return err
+	}
+
+	if f.config.Fsync == fsyncAlways {
+		if err := lf.flush(true); err != nil {
+			return err
+		}
+	}
+
+	if f.config.MaxSize > 0 && lf.size >= f.config.MaxSize {
+		f.closeFile(lf, true)
+	}
+
+	return nil
+}
+
+// housekeeping flushes open files, rotates those older than max_age, and
+// closes those not written to within the idle timeout, e.g. yesterday's
+// file once a date-based path has moved on
+func (f *FileServer) housekeeping(sync bool) {
+	now := time.Now()
+	idle := time.Duration(f.config.IdleTimeout) * time.Second
+	maxAge := time.Duration(f.config.MaxAge) * time.Second
+
+	for _, lf := range f.files {
+		switch {
+		case f.config.MaxAge > 0 && now.Sub(lf.opened) >= maxAge:
+			f.closeFile(lf, true)
+		case now.Sub(lf.lastWrite) >= idle:
+			f.closeFile(lf, false)
+		default:
+			if err := lf.flush(sync); err != nil {
+				log.Printf("[%s] Error flushing %s: %v", f.name, lf.path, err)
+			}
+		}
+	}
+}
+
+func (f *FileServer) Start() error {
+	if f.sender == nil {
+		log.Printf("[%s] No route is specified for this output", f.name)
+		return nil
+	}
+
+	f.files = make(map[string]*logFile)
+	f.open = make(map[string]bool)
+	f.archive = make(chan closedFile, archiveBuffer)
+	go f.archiver()
+
+	// Add the client as a subscriber
+	receiveChan := make(chan *buffer.Event, recvBuffer)
+	f.sender.AddSubscriber(f.name, receiveChan)
+	defer f.sender.DelSubscriber(f.name)
+
+	flushTick := time.NewTicker(time.Duration(flushInterval) * time.Second)
+	defer flushTick.Stop()
+	tick := time.NewTicker(time.Duration(rateDisplayInterval) * time.Second)
+	defer tick.Stop()
+	rateCounter := ratecounter.NewRateCounter(1 * time.Second)
+
+	lastSync := time.Now()
+	syncInterval := time.Duration(f.config.FsyncInterval) * time.Second
+
+	log.Printf("[%s] Started File Output Instance", f.name)
+
+	for {
+		select {
+		case ev := <-receiveChan:
+			if server.RandInt(0, 100) >= *f.config.SampleSize {
+				continue
+			}
+			if err := f.write(ev); err != nil {
+				log.Printf("[%s] Error writing event: %v", f.name, err)
+				continue
+			}
+			rateCounter.Incr(1)
+		case <-flushTick.C:
+			sync := f.config.Fsync == fsyncInterval && time.Since(lastSync) >= syncInterval
+			if sync {
+				lastSync = time.Now()
+			}
+			f.housekeeping(sync)
+		case <-tick.C:
+			if rateCounter.Rate() > 0 {
+				log.Printf("[%s] Current file output rate: %d/s\n", f.name, rateCounter.Rate())
+			}
+		case <-f.term:
+			log.Println("File output received term signal")
+			for _, lf := range f.files {
+				f.closeFile(lf, false)
+			}
+			close(f.archive)
+			return nil
+		}
+	}
+}
+
+func (f *FileServer) Stop() error {
+	f.term <- true
+	return nil
+}
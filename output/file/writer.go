@@ -0,0 +1,93 @@
+package file
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// logFile is a file being written. Events are buffered and flushed on the
+// flush interval, or after every write with the always fsync policy.
+type logFile struct {
+	path      string
+	glob      string
+	file      *os.File
+	writer    *bufio.Writer
+	size      int64
+	opened    time.Time
+	lastWrite time.Time
+}
+
+func openLogFile(path string, glob string) (*logFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	now := time.Now()
+
+	return &logFile{
+		path:      path,
+		glob:      glob,
+		file:      file,
+		writer:    bufio.NewWriter(file),
+		size:      info.Size(),
+		opened:    now,
+		lastWrite: now,
+	}, nil
+}
+
+func (f *logFile) write(line []byte) error {
+	n, err := f.writer.Write(line)
+	f.size += int64(n)
+	f.lastWrite = time.Now()
+	return err
+}
+
+// flush writes out the buffer, and syncs the file to disk if asked to
+func (f *logFile) flush(sync bool) error {
+	if err := f.writer.Flush(); err != nil {
+		return err
+	}
+
+	if sync {
+		return f.file.Sync()
+	}
+
+	return nil
+}
+
+func (f *logFile) close() error {
+	if err := f.flush(true); err != nil {
+		f.file.Close()
+		return err
+	}
+
+	return f.file.Close()
+}
+
+// rotatedName returns a free name for a rotated file, stamped with the
+// rotation time
+func rotatedName(path string, suffix string) string {
+	stamp := time.Now().Format("20060102T150405")
+	name := fmt.Sprintf("%s.%s", path, stamp)
+
+	for i := 1; ; i++ {
+		if _, err := os.Stat(name + suffix); os.IsNotExist(err) {
+			return name
+		}
+		name = fmt.Sprintf("%s.%s-%d", path, stamp, i)
+	}
+}
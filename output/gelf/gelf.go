@@ -0,0 +1,364 @@
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/packetzoom/logzoom/buffer"
+	"github.com/packetzoom/logzoom/output"
+	"github.com/packetzoom/logzoom/route"
+	"github.com/packetzoom/logzoom/server"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	recvBuffer       = 10000
+	defaultChunkSize = 1420
+	defaultLevel     = 6 // informational
+	maxChunks        = 128
+	chunkHeaderLen   = 12
+	retryInterval    = 2
+)
+
+type Config struct {
+	Host              string `yaml:"host"`
+	Protocol          string `yaml:"protocol"`
+	Compression       string `yaml:"compression"`
+	ChunkSize         int    `yaml:"chunk_size"`
+	ShortMessageField string `yaml:"short_message_field"`
+	HostField         string `yaml:"host_field"`
+	LevelField        string `yaml:"level_field"`
+	DefaultLevel      *int   `yaml:"default_level,omitempty"`
+	SampleSize        *int   `yaml:"sample_size,omitempty"`
+}
+
+type GELFServer struct {
+	name     string
+	config   Config
+	sender   buffer.Sender
+	hostname string
+	conn     net.Conn
+	term     chan bool
+}
+
+func init() {
+	output.Register("gelf", New)
+}
+
+func New() output.Output {
+	return &GELFServer{term: make(chan bool, 1)}
+}
+
+func (g *GELFServer) ValidateConfig(config *Config) error {
+	if len(config.Host) == 0 {
+		return errors.New("Missing host")
+	}
+
+	switch g.config.Protocol {
+	case "":
+		g.config.Protocol = "udp"
+	case "udp", "tcp":
+	default:
+		return fmt.Errorf("Unknown protocol %s (must be udp or tcp)", config.Protocol)
+	}
+
+	switch g.config.Compression {
+	case "":
+		g.config.Compression = "gzip"
+	case "gzip", "zlib", "none":
+	default:
+		return fmt.Errorf("Unknown compression %s (must be gzip, zlib or none)", config.Compression)
+	}
+
+	if g.config.ChunkSize <= 0 {
+		g.config.ChunkSize = defaultChunkSize
+	}
+	if g.config.ChunkSize <= chunkHeaderLen {
+		return fmt.Errorf("chunk_size must be larger than the %d byte chunk header", chunkHeaderLen)
+	}
+
+	if len(g.config.ShortMessageField) == 0 {
+		g.config.ShortMessageField = "message"
+	}
+
+	if len(g.config.HostField) == 0 {
+		g.config.HostField = "host"
+	}
+
+	if len(g.config.LevelField) == 0 {
+		g.config.LevelField = "level"
+	}
+
+	if g.config.DefaultLevel == nil {
+		i := defaultLevel
+		g.config.DefaultLevel = &i
+	}
+
+	if g.config.SampleSize == nil {
+		i := 100
+		g.config.SampleSize = &i
+	}
+	log.Printf("[%s] Setting Sample Size to %d", g.name, *g.config.SampleSize)
+
+	return nil
+}
+
+func (g *GELFServer) Init(name string, config yaml.MapSlice, sender buffer.Sender, route route.Route) error {
+	var gelfConfig *Config
+
+	// go-yaml doesn't have a great way to partially unmarshal YAML data
+	// See https://github.com/go-yaml/yaml/issues/13
+	yamlConfig, _ := yaml.Marshal(config)
+
+	if err := yaml.Unmarshal(yamlConfig, &gelfConfig); err != nil {
+		return fmt.Errorf("Error parsing GELF config: %v", err)
+	}
+
+	g.name = name
+	g.config = *gelfConfig
+	g.sender = sender
+	g.hostname, _ = os.Hostname()
+
+	if err := g.ValidateConfig(gelfConfig); err != nil {
+		return fmt.Errorf("Error in config: %v", err)
+	}
+
+	return nil
+}
+
+func toLevel(value interface{}) (int, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		i, err := v.Int64()
+		return int(i), err == nil
+	case float64:
+		return int(v), true
+	case int:
+		return v, true
+	case string:
+		i, err := strconv.Atoi(v)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+// toTimestamp accepts both GELF style epoch seconds and RFC3339 strings
+// such as the timestamp set by the Lumberjack input
+func toTimestamp(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return 0, false
+		}
+		return float64(t.UnixNano()) / float64(time.Second), true
+	}
+	return 0, false
+}
+
+// toGELF converts an event into a GELF message. The short message, host and
+// level are taken from the configured fields and every other field is sent
+// as an additional field.
+func (g *GELFServer) toGELF(ev *buffer.Event) ([]byte, error) {
+	message := map[string]interface{}{
+		"version":   "1.1",
+		"host":      g.hostname,
+		"timestamp": float64(time.Now().UnixNano()) / float64(time.Second),
+		"level":     *g.config.DefaultLevel,
+	}
+
+	var fields map[string]interface{}
+	if ev.Fields != nil {
+		fields = *ev.Fields
+	}
+
+	// Events from the GELF input carry short_message rather than message
+	if short, ok := fields[g.config.ShortMessageField]; ok {
+		message["short_message"] = fmt.Sprint(short)
+	} else if short, ok := fields["short_message"]; ok {
+		message["short_message"] = fmt.Sprint(short)
+	} else if ev.Text != nil {
+		message["short_message"] = *ev.Text
+	} else {
+		return nil, errors.New("event has no message")
+	}
+
+	if host, ok := fields[g.config.HostField]; ok {
+		message["host"] = fmt.Sprint(host)
+	}
+
+	if level, ok := toLevel(fields[g.config.LevelField]); ok {
+		message["level"] = level
+	}
+
+	if timestamp, ok := toTimestamp(fields["timestamp"]); ok {
+		message["timestamp"] = timestamp
+	}
+
+	if full, ok := fields["full_message"]; ok {
+		message["full_message"] = fmt.Sprint(full)
+	}
+
+	for key, value := range fields {
+		switch key {
+		case g.config.ShortMessageField, g.config.HostField, g.config.LevelField,
+			"version", "short_message", "full_message", "timestamp", "id", "_id":
+			continue
+		}
+		message["_"+key] = value
+	}
+
+	return json.Marshal(message)
+}
+
+func (g *GELFServer) compress(payload []byte) ([]byte, error) {
+	var b bytes.Buffer
+
+	switch g.config.Compression {
+	case "gzip":
+		w := gzip.NewWriter(&b)
+		w.Write(payload)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case "zlib":
+		w := zlib.NewWriter(&b)
+		w.Write(payload)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return payload, nil
+	}
+
+	return b.Bytes(), nil
+}
+
+// writeUDP sends a message as a single datagram, or as GELF chunks when it
+// is larger than the configured chunk size
+func (g *GELFServer) writeUDP(payload []byte) error {
+	payload, err := g.compress(payload)
+	if err != nil {
+		return err
+	}
+
+	if len(payload) <= g.config.ChunkSize {
+		_, err := g.conn.Write(payload)
+		return err
+	}
+
+	size := g.config.ChunkSize - chunkHeaderLen
+	count := (len(payload) + size - 1) / size
+	if count > maxChunks {
+		return fmt.Errorf("message too large (%d chunks)", count)
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		chunk := make([]byte, 0, chunkHeaderLen+end-i*size)
+		chunk = append(chunk, 0x1e, 0x0f)
+		chunk = append(chunk, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, payload[i*size:end]...)
+
+		if _, err := g.conn.Write(chunk); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeTCP sends an uncompressed, null byte terminated message
+func (g *GELFServer) writeTCP(payload []byte) error {
+	_, err := g.conn.Write(append(payload, 0))
+	return err
+}
+
+func (g *GELFServer) write(ev *buffer.Event) error {
+	payload, err := g.toGELF(ev)
+	if err != nil {
+		return err
+	}
+
+	if g.conn == nil {
+		conn, err := net.Dial(g.config.Protocol, g.config.Host)
+		if err != nil {
+			return err
+		}
+		g.conn = conn
+	}
+
+	if g.config.Protocol == "tcp" {
+		err = g.writeTCP(payload)
+	} else {
+		err = g.writeUDP(payload)
+	}
+
+	if err != nil {
+		g.conn.Close()
+		g.conn = nil
+	}
+
+	return err
+}
+
+func (g *GELFServer) Start() error {
+	if g.sender == nil {
+		log.Printf("[%s] No route is specified for this output", g.name)
+		return nil
+	}
+
+	// Add the client as a subscriber
+	receiveChan := make(chan *buffer.Event, recvBuffer)
+	g.sender.AddSubscriber(g.name, receiveChan)
+	defer g.sender.DelSubscriber(g.name)
+
+	log.Printf("[%s] Started GELF Output Instance", g.name)
+
+	for {
+		select {
+		case ev := <-receiveChan:
+			if server.RandInt(0, 100) >= *g.config.SampleSize {
+				continue
+			}
+			if err := g.write(ev); err != nil {
+				log.Printf("[%s] Error sending GELF message: %v", g.name, err)
+				time.Sleep(retryInterval * time.Second)
+			}
+		case <-g.term:
+			log.Println("GELF output received term signal")
+			if g.conn != nil {
+				g.conn.Close()
+			}
+			return nil
+		}
+	}
+}
+
+func (g *GELFServer) Stop() error {
+	g.term <- true
+	return nil
+}
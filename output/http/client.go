@@ -0,0 +1,187 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	nethttp "net/http"
+	"strconv"
+	"time"
+
+	"github.com/packetzoom/logzoom/buffer"
+)
+
+// batch holds events bound for the same resolved URL
+type batch struct {
+	url    string
+	events []*buffer.Event
+}
+
+// retryableError is returned for responses worth sending again, with the
+// delay requested by the server if any
+type retryableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+// encodeEvent returns the JSON document for an event: its fields when the
+// input decoded any, otherwise the text as the message
+func encodeEvent(ev *buffer.Event) ([]byte, error) {
+	if ev.Fields != nil && len(*ev.Fields) > 0 {
+		return json.Marshal(ev.Fields)
+	}
+
+	return json.Marshal(map[string]interface{}{"message": *ev.Text})
+}
+
+// encodeBody builds a request body in the configured format
+func encodeBody(format string, events []*buffer.Event) ([]byte, error) {
+	var body bytes.Buffer
+
+	if format == formatJSONArray {
+		body.WriteByte('[')
+	}
+
+	for i, ev := range events {
+		doc, err := encodeEvent(ev)
+		if err != nil {
+			return nil, err
+		}
+
+		if format == formatJSONArray && i > 0 {
+			body.WriteByte(',')
+		}
+		body.Write(doc)
+		if format == formatNDJSON {
+			body.WriteByte('\n')
+		}
+	}
+
+	if format == formatJSONArray {
+		body.WriteByte(']')
+	}
+
+	return body.Bytes(), nil
+}
+
+// retryAfter parses the Retry-After header, which is either a number of
+// seconds or an HTTP date
+func retryAfter(resp *nethttp.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if len(value) == 0 {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if t, err := nethttp.ParseTime(value); err == nil {
+		return t.Sub(time.Now())
+	}
+
+	return 0
+}
+
+func (h *HTTPServer) newRequest(url string, body []byte) (*nethttp.Request, error) {
+	var reader io.Reader = bytes.NewReader(body)
+
+	if h.config.Gzip {
+		var compressed bytes.Buffer
+		w := gzip.NewWriter(&compressed)
+		w.Write(body)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		reader = &compressed
+	}
+
+	req, err := nethttp.NewRequest(h.config.Method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", contentTypes[h.config.Format])
+	if h.config.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	for key, value := range h.config.Headers {
+		req.Header.Set(key, value)
+	}
+
+	if len(h.config.BearerToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+h.config.BearerToken)
+	} else if len(h.config.Username) > 0 {
+		req.SetBasicAuth(h.config.Username, h.config.Password)
+	}
+
+	return req, nil
+}
+
+// do sends a single request. 5xx and 429 responses are retryable; other
+// non-2xx responses are not.
+func (h *HTTPServer) do(url string, body []byte) error {
+	req, err := h.newRequest(url, body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return &retryableError{err: err}
+	}
+	defer resp.Body.Close()
+
+	// Drain the body so the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	err = fmt.Errorf("server returned %s", resp.Status)
+	if resp.StatusCode == 429 || resp.StatusCode >= 500 {
+		return &retryableError{err: err, retryAfter: retryAfter(resp)}
+	}
+
+	return err
+}
+
+// send posts a body, retrying up to max_retries times with exponential
+// backoff, or after the delay given by Retry-After
+func (h *HTTPServer) send(url string, body []byte) error {
+	backoff := time.Second
+
+	for attempt := 0; ; attempt++ {
+		err := h.do(url, body)
+		if err == nil {
+			return nil
+		}
+
+		retryable, ok := err.(*retryableError)
+		if !ok || attempt >= *h.config.MaxRetries {
+			return err
+		}
+
+		delay := backoff
+		if retryable.retryAfter > 0 {
+			delay = retryable.retryAfter
+		}
+		if delay > maxRetryBackoff {
+			delay = maxRetryBackoff
+		}
+
+		log.Printf("[%s] Error posting to %s: %v, retrying in %s", h.name, url, err, delay)
+		time.Sleep(delay)
+		backoff *= 2
+	}
+}
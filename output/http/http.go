@@ -0,0 +1,299 @@
+package http
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	nethttp "net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/packetzoom/logzoom/buffer"
+	"github.com/packetzoom/logzoom/output"
+	"github.com/packetzoom/logzoom/route"
+	"github.com/packetzoom/logzoom/server"
+	"github.com/paulbellamy/ratecounter"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	recvBuffer           = 10000
+	rateDisplayInterval  = 10
+	defaultBatchSize     = 100
+	defaultFlushInterval = 1
+	defaultTimeout       = 30
+	defaultMaxRetries    = 3
+	defaultWorkers       = 1
+	maxRetryBackoff      = 60 * time.Second
+
+	formatNDJSON    = "ndjson"
+	formatJSONArray = "json_array"
+	formatSingle    = "single"
+)
+
+var contentTypes = map[string]string{
+	formatNDJSON:    "application/x-ndjson",
+	formatJSONArray: "application/json",
+	formatSingle:    "application/json",
+}
+
+type Config struct {
+	URL                   string            `yaml:"url"`
+	Method                string            `yaml:"method"`
+	Format                string            `yaml:"format"`
+	Headers               map[string]string `yaml:"headers"`
+	Gzip                  bool              `yaml:"gzip"`
+	Username              string            `yaml:"username"`
+	Password              string            `yaml:"password"`
+	BearerToken           string            `yaml:"bearer_token"`
+	BatchSize             int               `yaml:"batch_size"`
+	FlushInterval         int               `yaml:"flush_interval"`
+	Timeout               int               `yaml:"timeout"`
+	MaxRetries            *int              `yaml:"max_retries,omitempty"`
+	Workers               int               `yaml:"workers"`
+	SSLCA                 string            `yaml:"ssl_ca"`
+	SSLCrt                string            `yaml:"ssl_crt"`
+	SSLKey                string            `yaml:"ssl_key"`
+	SSLInsecureSkipVerify bool              `yaml:"ssl_insecure_skip_verify"`
+	SampleSize            *int              `yaml:"sample_size,omitempty"`
+}
+
+type HTTPServer struct {
+	name    string
+	config  Config
+	sender  buffer.Sender
+	client  *nethttp.Client
+	batches chan *batch
+	term    chan bool
+}
+
+func init() {
+	output.Register("http", New)
+}
+
+func New() output.Output {
+	return &HTTPServer{term: make(chan bool, 1)}
+}
+
+func (h *HTTPServer) ValidateConfig(config *Config) error {
+	if len(config.URL) == 0 {
+		return errors.New("Missing url")
+	}
+
+	if (len(config.SSLCrt) > 0) != (len(config.SSLKey) > 0) {
+		return errors.New("Both ssl_crt and ssl_key are required for a client certificate")
+	}
+
+	if len(h.config.Method) == 0 {
+		h.config.Method = "POST"
+	}
+	h.config.Method = strings.ToUpper(h.config.Method)
+
+	switch h.config.Format {
+	case "":
+		h.config.Format = formatNDJSON
+	case formatNDJSON, formatJSONArray, formatSingle:
+	default:
+		return fmt.Errorf("Unknown format %s (must be ndjson, json_array or single)", config.Format)
+	}
+
+	if h.config.BatchSize <= 0 {
+		h.config.BatchSize = defaultBatchSize
+	}
+
+	if h.config.FlushInterval <= 0 {
+		h.config.FlushInterval = defaultFlushInterval
+	}
+
+	if h.config.Timeout <= 0 {
+		h.config.Timeout = defaultTimeout
+	}
+
+	if h.config.MaxRetries == nil {
+		i := defaultMaxRetries
+		h.config.MaxRetries = &i
+	}
+
+	if h.config.Workers <= 0 {
+		h.config.Workers = defaultWorkers
+	}
+
+	if h.config.SampleSize == nil {
+		i := 100
+		h.config.SampleSize = &i
+	}
+	log.Printf("[%s] Setting Sample Size to %d", h.name, *h.config.SampleSize)
+
+	return nil
+}
+
+func (h *HTTPServer) Init(name string, config yaml.MapSlice, sender buffer.Sender, route route.Route) error {
+	var httpConfig *Config
+
+	// go-yaml doesn't have a great way to partially unmarshal YAML data
+	// See https://github.com/go-yaml/yaml/issues/13
+	yamlConfig, _ := yaml.Marshal(config)
+
+	if err := yaml.Unmarshal(yamlConfig, &httpConfig); err != nil {
+		return fmt.Errorf("Error parsing HTTP config: %v", err)
+	}
+
+	h.name = name
+	h.config = *httpConfig
+	h.sender = sender
+
+	if err := h.ValidateConfig(httpConfig); err != nil {
+		return fmt.Errorf("Error in config: %v", err)
+	}
+
+	return nil
+}
+
+func (h *HTTPServer) tlsConfig() (*tls.Config, error) {
+	return server.ClientTLSConfig(h.config.SSLCA, h.config.SSLCrt, h.config.SSLKey, h.config.SSLInsecureSkipVerify)
+}
+
+// worker posts batches until the channel is closed. Running several
+// workers bounds the number of requests in flight.
+func (h *HTTPServer) worker() {
+	for b := range h.batches {
+		if h.config.Format == formatSingle {
+			for _, ev := range b.events {
+				h.post(b.url, []*buffer.Event{ev})
+			}
+			continue
+		}
+
+		h.post(b.url, b.events)
+	}
+}
+
+func (h *HTTPServer) post(url string, events []*buffer.Event) {
+	body, err := encodeBody(h.config.Format, events)
+	if err != nil {
+		log.Printf("[%s] Error encoding %d events: %v", h.name, len(events), err)
+		return
+	}
+
+	if err := h.send(url, body); err != nil {
+		log.Printf("[%s] Dropping %d events for %s: %v", h.name, len(events), url, err)
+	}
+}
+
+// expandURL resolves the field references of the URL. Values are escaped
+// for the part of the URL they appear in, so a field can't add path
+// segments or query parameters.
+func (h *HTTPServer) expandURL(ev *buffer.Event) (string, error) {
+	path, query := h.config.URL, ""
+	if i := strings.Index(path, "?"); i >= 0 {
+		path, query = path[:i], path[i:]
+	}
+
+	path, err := buffer.ExpandFields(path, escapedField(ev, url.PathEscape))
+	if err != nil {
+		return "", err
+	}
+
+	query, err = buffer.ExpandFields(query, escapedField(ev, url.QueryEscape))
+	if err != nil {
+		return "", err
+	}
+
+	return path + query, nil
+}
+
+// escapedField looks up event fields and escapes their values
+func escapedField(ev *buffer.Event, escape func(string) string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := ev.FieldString(key)
+		return escape(value), ok
+	}
+}
+
+// flush queues the pending events of every URL
+func (h *HTTPServer) flush(pending map[string][]*buffer.Event) {
+	for url, events := range pending {
+		h.batches <- &batch{url: url, events: events}
+		delete(pending, url)
+	}
+}
+
+func (h *HTTPServer) Start() error {
+	if h.sender == nil {
+		log.Printf("[%s] No route is specified for this output", h.name)
+		return nil
+	}
+
+	tlsConfig, err := h.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	h.client = &nethttp.Client{
+		Timeout: time.Duration(h.config.Timeout) * time.Second,
+		Transport: &nethttp.Transport{
+			Proxy:               nethttp.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConnsPerHost: h.config.Workers,
+		},
+	}
+
+	h.batches = make(chan *batch, h.config.Workers)
+	for i := 0; i < h.config.Workers; i++ {
+		go h.worker()
+	}
+
+	// Add the client as a subscriber
+	receiveChan := make(chan *buffer.Event, recvBuffer)
+	h.sender.AddSubscriber(h.name, receiveChan)
+	defer h.sender.DelSubscriber(h.name)
+
+	flushTick := time.NewTicker(time.Duration(h.config.FlushInterval) * time.Second)
+	defer flushTick.Stop()
+	tick := time.NewTicker(time.Duration(rateDisplayInterval) * time.Second)
+	defer tick.Stop()
+	rateCounter := ratecounter.NewRateCounter(1 * time.Second)
+
+	// Events are grouped by the URL they resolve to
+	pending := make(map[string][]*buffer.Event)
+
+	log.Printf("[%s] Started HTTP Output Instance", h.name)
+
+	for {
+		select {
+		case ev := <-receiveChan:
+			if server.RandInt(0, 100) >= *h.config.SampleSize {
+				continue
+			}
+			target, err := h.expandURL(ev)
+			if err != nil {
+				log.Printf("[%s] Dropping event: %v", h.name, err)
+				continue
+			}
+			rateCounter.Incr(1)
+			pending[target] = append(pending[target], ev)
+			if len(pending[target]) >= h.config.BatchSize {
+				h.batches <- &batch{url: target, events: pending[target]}
+				delete(pending, target)
+			}
+		case <-flushTick.C:
+			h.flush(pending)
+		case <-tick.C:
+			if rateCounter.Rate() > 0 {
+				log.Printf("[%s] Current HTTP output rate: %d/s\n", h.name, rateCounter.Rate())
+			}
+		case <-h.term:
+			log.Println("HTTP output received term signal")
+			h.flush(pending)
+			close(h.batches)
+			return nil
+		}
+	}
+}
+
+func (h *HTTPServer) Stop() error {
+	h.term <- true
+	return nil
+}
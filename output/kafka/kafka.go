@@ -0,0 +1,270 @@
+package kafka
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/packetzoom/logzoom/buffer"
+	"github.com/packetzoom/logzoom/output"
+	"github.com/packetzoom/logzoom/route"
+	"github.com/packetzoom/logzoom/server"
+	"github.com/paulbellamy/ratecounter"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	recvBuffer           = 10000
+	rateDisplayInterval  = 10
+	defaultVersion       = "1.0.0"
+	defaultBatchSize     = 1000
+	defaultFlushInterval = 500
+	defaultMaxRetries    = 3
+)
+
+type Config struct {
+	Brokers               []string `yaml:"brokers"`
+	ClientID              string   `yaml:"client_id"`
+	Version               string   `yaml:"version"`
+	Topic                 string   `yaml:"topic"`
+	FallbackTopic         string   `yaml:"fallback_topic"`
+	KeyField              string   `yaml:"key_field"`
+	Format                string   `yaml:"format"`
+	BatchSize             int      `yaml:"batch_size"`
+	BatchBytes            int      `yaml:"batch_bytes"`
+	FlushInterval         int      `yaml:"flush_interval"`
+	Compression           string   `yaml:"compression"`
+	RequiredAcks          string   `yaml:"required_acks"`
+	MaxRetries            int      `yaml:"max_retries"`
+	Timeout               int      `yaml:"timeout"`
+	TLS                   bool     `yaml:"tls"`
+	SSLCA                 string   `yaml:"ssl_ca"`
+	SSLCrt                string   `yaml:"ssl_crt"`
+	SSLKey                string   `yaml:"ssl_key"`
+	SSLInsecureSkipVerify bool     `yaml:"ssl_insecure_skip_verify"`
+	SASLMechanism         string   `yaml:"sasl_mechanism"`
+	SASLUsername          string   `yaml:"sasl_username"`
+	SASLPassword          string   `yaml:"sasl_password"`
+	SampleSize            *int     `yaml:"sample_size,omitempty"`
+}
+
+type KafkaServer struct {
+	name     string
+	config   Config
+	sender   buffer.Sender
+	producer sarama.AsyncProducer
+	term     chan bool
+}
+
+// newProducer creates the producer used by the output. Tests replace it to
+// produce to a sarama.MockBroker.
+var newProducer = sarama.NewAsyncProducer
+
+func init() {
+	output.Register("kafka", New)
+}
+
+func New() output.Output {
+	return &KafkaServer{term: make(chan bool, 1)}
+}
+
+func (k *KafkaServer) ValidateConfig(config *Config) error {
+	if len(config.Brokers) == 0 {
+		return errors.New("Missing brokers")
+	}
+
+	if len(config.Topic) == 0 {
+		return errors.New("Missing topic")
+	}
+
+	if len(k.config.ClientID) == 0 {
+		k.config.ClientID = "logzoom"
+	}
+
+	if len(k.config.Version) == 0 {
+		k.config.Version = defaultVersion
+	}
+	version, err := sarama.ParseKafkaVersion(k.config.Version)
+	if err != nil {
+		return fmt.Errorf("Invalid version %s: %v", k.config.Version, err)
+	}
+
+	switch k.config.Format {
+	case "":
+		k.config.Format = "text"
+	case "text", "json":
+	default:
+		return fmt.Errorf("Unknown format %s (must be text or json)", config.Format)
+	}
+
+	if len(k.config.Compression) == 0 {
+		k.config.Compression = "none"
+	}
+	if _, ok := compressionCodecs[k.config.Compression]; !ok {
+		return fmt.Errorf("Unknown compression %s", config.Compression)
+	}
+	if k.config.Compression == "zstd" && !version.IsAtLeast(sarama.V2_1_0_0) {
+		return fmt.Errorf("zstd compression requires version 2.1.0 or later (version is %s)", k.config.Version)
+	}
+
+	if len(k.config.RequiredAcks) == 0 {
+		k.config.RequiredAcks = "leader"
+	}
+	if _, ok := requiredAcks[k.config.RequiredAcks]; !ok {
+		return fmt.Errorf("Unknown required_acks %s (must be none, leader or all)", config.RequiredAcks)
+	}
+
+	if k.config.BatchSize <= 0 {
+		k.config.BatchSize = defaultBatchSize
+	}
+
+	if k.config.FlushInterval <= 0 {
+		k.config.FlushInterval = defaultFlushInterval
+	}
+
+	if k.config.MaxRetries <= 0 {
+		k.config.MaxRetries = defaultMaxRetries
+	}
+
+	if k.config.SampleSize == nil {
+		i := 100
+		k.config.SampleSize = &i
+	}
+	log.Printf("[%s] Setting Sample Size to %d", k.name, *k.config.SampleSize)
+
+	return nil
+}
+
+func (k *KafkaServer) Init(name string, config yaml.MapSlice, sender buffer.Sender, route route.Route) error {
+	var kafkaConfig *Config
+
+	// go-yaml doesn't have a great way to partially unmarshal YAML data
+	// See https://github.com/go-yaml/yaml/issues/13
+	yamlConfig, _ := yaml.Marshal(config)
+
+	if err := yaml.Unmarshal(yamlConfig, &kafkaConfig); err != nil {
+		return fmt.Errorf("Error parsing Kafka config: %v", err)
+	}
+
+	k.name = name
+	k.config = *kafkaConfig
+	k.sender = sender
+
+	if err := k.ValidateConfig(kafkaConfig); err != nil {
+		return fmt.Errorf("Error in config: %v", err)
+	}
+
+	return nil
+}
+
+// message builds the producer message for an event. The topic is resolved
+// from the template, and the key field keeps events with the same value on
+// the same partition.
+func (k *KafkaServer) message(ev *buffer.Event) (*sarama.ProducerMessage, error) {
+	topic, err := ev.Expand(k.config.Topic)
+	if err != nil {
+		if len(k.config.FallbackTopic) == 0 {
+			return nil, err
+		}
+		topic = k.config.FallbackTopic
+	}
+
+	var value []byte
+	switch {
+	case k.config.Format == "json" && ev.Fields != nil, ev.Text == nil && ev.Fields != nil:
+		if value, err = json.Marshal(ev.Fields); err != nil {
+			return nil, err
+		}
+	case ev.Text != nil:
+		value = []byte(*ev.Text)
+	default:
+		return nil, errors.New("event has no text or fields")
+	}
+
+	msg := &sarama.ProducerMessage{
+		Topic: topic,
+		Value: sarama.ByteEncoder(value),
+	}
+
+	if len(k.config.KeyField) > 0 {
+		if key, ok := ev.FieldString(k.config.KeyField); ok {
+			msg.Key = sarama.StringEncoder(key)
+		}
+	}
+
+	return msg, nil
+}
+
+func (k *KafkaServer) readErrors() {
+	for err := range k.producer.Errors() {
+		log.Printf("[%s] Error producing to %s: %v", k.name, err.Msg.Topic, err.Err)
+	}
+}
+
+func (k *KafkaServer) Start() error {
+	if k.sender == nil {
+		log.Printf("[%s] No route is specified for this output", k.name)
+		return nil
+	}
+
+	config, err := k.saramaConfig()
+	if err != nil {
+		return fmt.Errorf("Error in Kafka config: %v", err)
+	}
+
+	for {
+		k.producer, err = newProducer(k.config.Brokers, config)
+		if err == nil {
+			break
+		}
+		log.Printf("[%s] Error connecting to Kafka: %v, will retry", k.name, err)
+		time.Sleep(2 * time.Second)
+	}
+
+	go k.readErrors()
+
+	// Add the client as a subscriber
+	receiveChan := make(chan *buffer.Event, recvBuffer)
+	k.sender.AddSubscriber(k.name, receiveChan)
+	defer k.sender.DelSubscriber(k.name)
+
+	log.Printf("[%s] Started Kafka Output Instance", k.name)
+
+	tick := time.NewTicker(time.Duration(rateDisplayInterval) * time.Second)
+	defer tick.Stop()
+	rateCounter := ratecounter.NewRateCounter(1 * time.Second)
+
+	for {
+		select {
+		case ev := <-receiveChan:
+			if server.RandInt(0, 100) >= *k.config.SampleSize {
+				continue
+			}
+			msg, err := k.message(ev)
+			if err != nil {
+				log.Printf("[%s] Dropping event: %v", k.name, err)
+				continue
+			}
+			k.producer.Input() <- msg
+			rateCounter.Incr(1)
+		case <-tick.C:
+			if rateCounter.Rate() > 0 {
+				log.Printf("[%s] Current Kafka output rate: %d/s\n", k.name, rateCounter.Rate())
+			}
+		case <-k.term:
+			log.Println("Kafka output received term signal")
+			if err := k.producer.Close(); err != nil {
+				log.Printf("[%s] Error closing Kafka producer: %v", k.name, err)
+			}
+			return nil
+		}
+	}
+}
+
+func (k *KafkaServer) Stop() error {
+	k.term <- true
+	return nil
+}
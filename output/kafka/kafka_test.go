@@ -0,0 +1,140 @@
+package kafka
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/packetzoom/logzoom/buffer"
+)
+
+// testSender hands the subscriber channel of the output to the test
+type testSender struct {
+	subscribers chan chan *buffer.Event
+}
+
+func (s *testSender) AddSubscriber(name string, ch chan *buffer.Event) error {
+	s.subscribers <- ch
+	return nil
+}
+
+func (s *testSender) DelSubscriber(name string) error {
+	return nil
+}
+
+func newEvent(text string, fields map[string]interface{}) *buffer.Event {
+	return &buffer.Event{Text: &text, Fields: &fields}
+}
+
+func TestPerEventTopicsAndKeys(t *testing.T) {
+	broker := sarama.NewMockBroker(t, 1)
+	defer broker.Close()
+
+	metadata := sarama.NewMockMetadataResponse(t).SetBroker(broker.Addr(), broker.BrokerID())
+	for _, topic := range []string{"logs-web", "logs-db", "logs-other"} {
+		for partition := int32(0); partition < 4; partition++ {
+			metadata.SetLeader(topic, partition, broker.BrokerID())
+		}
+	}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": metadata,
+		// Version 3 is the produce API of the default Kafka version, 1.0.0
+		"ProduceRequest": sarama.NewMockProduceResponse(t).SetVersion(3),
+	})
+
+	// Report successes, so the test sees where each message went
+	producers := make(chan sarama.AsyncProducer, 1)
+	defer func(f func([]string, *sarama.Config) (sarama.AsyncProducer, error)) { newProducer = f }(newProducer)
+	newProducer = func(addrs []string, config *sarama.Config) (sarama.AsyncProducer, error) {
+		config.Producer.Return.Successes = true
+		config.Producer.Flush.Messages = 1
+		producer, err := sarama.NewAsyncProducer(addrs, config)
+		if err == nil {
+			producers <- producer
+		}
+		return producer, err
+	}
+
+	sender := &testSender{subscribers: make(chan chan *buffer.Event, 1)}
+	k := New().(*KafkaServer)
+	k.name = "kafka"
+	k.sender = sender
+	k.config = Config{
+		Brokers:       []string{broker.Addr()},
+		Topic:         "logs-%{service}",
+		FallbackTopic: "logs-other",
+		KeyField:      "host",
+	}
+	if err := k.ValidateConfig(&k.config); err != nil {
+		t.Fatal(err)
+	}
+
+	go k.Start()
+	defer k.Stop()
+
+	events := <-sender.subscribers
+	producer := <-producers
+
+	events <- newEvent("a", map[string]interface{}{"service": "web", "host": "web-1"})
+	events <- newEvent("b", map[string]interface{}{"service": "db", "host": "db-1"})
+	events <- newEvent("c", map[string]interface{}{"host": "web-1"})
+	events <- newEvent("d", map[string]interface{}{"service": "web", "host": "web-1"})
+
+	expected := map[string]string{
+		"a": "logs-web",
+		"b": "logs-db",
+		"c": "logs-other",
+		"d": "logs-web",
+	}
+	partitions := make(map[string]int32)
+
+	for len(partitions) < len(expected) {
+		select {
+		case msg := <-producer.Successes():
+			value, _ := msg.Value.Encode()
+			key, _ := msg.Key.Encode()
+
+			if topic := expected[string(value)]; msg.Topic != topic {
+				t.Errorf("event %s was produced to %s, expected %s", value, msg.Topic, topic)
+			}
+			if string(value) != "b" && string(key) != "web-1" {
+				t.Errorf("event %s has key %s, expected web-1", value, key)
+			}
+			partitions[string(value)] = msg.Partition
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timed out with %d of %d messages produced", len(partitions), len(expected))
+		}
+	}
+
+	if partitions["a"] != partitions["d"] {
+		t.Errorf("events with the same key went to partitions %d and %d", partitions["a"], partitions["d"])
+	}
+}
+
+func TestMessageWithoutText(t *testing.T) {
+	k := &KafkaServer{config: Config{Topic: "logs", Format: "text"}}
+
+	msg, err := k.message(&buffer.Event{Fields: &map[string]interface{}{"message": "hello"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := msg.Value.Encode(); string(value) != `{"message":"hello"}` {
+		t.Errorf("unexpected value %s", value)
+	}
+
+	if _, err := k.message(&buffer.Event{}); err == nil {
+		t.Error("expected an error for an event without text or fields")
+	}
+}
+
+func TestZstdRequiresKafka21(t *testing.T) {
+	k := &KafkaServer{config: Config{Brokers: []string{"localhost:9092"}, Topic: "logs", Compression: "zstd"}}
+	if err := k.ValidateConfig(&k.config); err == nil {
+		t.Error("expected zstd with the default version to be rejected")
+	}
+
+	k = &KafkaServer{config: Config{Brokers: []string{"localhost:9092"}, Topic: "logs", Compression: "zstd", Version: "2.1.0"}}
+	if err := k.ValidateConfig(&k.config); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
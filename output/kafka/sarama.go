@@ -0,0 +1,92 @@
+package kafka
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/packetzoom/logzoom/server"
+)
+
+var compressionCodecs = map[string]sarama.CompressionCodec{
+	"none":   sarama.CompressionNone,
+	"gzip":   sarama.CompressionGZIP,
+	"snappy": sarama.CompressionSnappy,
+	"lz4":    sarama.CompressionLZ4,
+	"zstd":   sarama.CompressionZSTD,
+}
+
+var requiredAcks = map[string]sarama.RequiredAcks{
+	"none":   sarama.NoResponse,
+	"leader": sarama.WaitForLocal,
+	"all":    sarama.WaitForAll,
+}
+
+func (k *KafkaServer) tlsConfig() (*tls.Config, error) {
+	return server.ClientTLSConfig(k.config.SSLCA, k.config.SSLCrt, k.config.SSLKey, k.config.SSLInsecureSkipVerify)
+}
+
+// saramaConfig translates the output configuration into a producer
+// configuration
+func (k *KafkaServer) saramaConfig() (*sarama.Config, error) {
+	config := sarama.NewConfig()
+	config.ClientID = k.config.ClientID
+
+	version, err := sarama.ParseKafkaVersion(k.config.Version)
+	if err != nil {
+		return nil, err
+	}
+	config.Version = version
+
+	config.Producer.Return.Successes = false
+	config.Producer.Return.Errors = true
+	config.Producer.Partitioner = sarama.NewHashPartitioner
+	config.Producer.Compression = compressionCodecs[k.config.Compression]
+	config.Producer.RequiredAcks = requiredAcks[k.config.RequiredAcks]
+	config.Producer.Retry.Max = k.config.MaxRetries
+	config.Producer.Flush.Messages = k.config.BatchSize
+	config.Producer.Flush.Bytes = k.config.BatchBytes
+	config.Producer.Flush.Frequency = time.Duration(k.config.FlushInterval) * time.Millisecond
+
+	if k.config.Timeout > 0 {
+		config.Producer.Timeout = time.Duration(k.config.Timeout) * time.Second
+		config.Net.DialTimeout = time.Duration(k.config.Timeout) * time.Second
+	}
+
+	if k.config.TLS {
+		tlsConfig, err := k.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = tlsConfig
+	}
+
+	if len(k.config.SASLMechanism) > 0 {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = k.config.SASLUsername
+		config.Net.SASL.Password = k.config.SASLPassword
+		config.Net.SASL.Mechanism = sarama.SASLMechanism(k.config.SASLMechanism)
+
+		switch k.config.SASLMechanism {
+		case sarama.SASLTypePlaintext:
+		case sarama.SASLTypeSCRAMSHA256:
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{HashGeneratorFcn: sha256Generator}
+			}
+		case sarama.SASLTypeSCRAMSHA512:
+			config.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+				return &scramClient{HashGeneratorFcn: sha512Generator}
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported SASL mechanism %s", k.config.SASLMechanism)
+		}
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
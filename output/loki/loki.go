@@ -0,0 +1,242 @@
+package loki
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/packetzoom/logzoom/buffer"
+	"github.com/packetzoom/logzoom/output"
+	"github.com/packetzoom/logzoom/route"
+	"github.com/packetzoom/logzoom/server"
+	"github.com/paulbellamy/ratecounter"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	recvBuffer            = 10000
+	rateDisplayInterval   = 10
+	defaultBatchSize      = 1000
+	defaultBatchBytes     = 1024 * 1024
+	defaultFlushInterval  = 1
+	defaultTimeout        = 30
+	defaultMaxRetries     = 5
+	defaultMaxStreams     = 1000
+	defaultTimestampField = "timestamp"
+	maxRetryBackoff       = 60 * time.Second
+
+	encodingProtobuf = "protobuf"
+	encodingJSON     = "json"
+)
+
+type Config struct {
+	URL                   string            `yaml:"url"`
+	Encoding              string            `yaml:"encoding"`
+	Labels                []string          `yaml:"labels"`
+	StaticLabels          map[string]string `yaml:"static_labels"`
+	MaxStreams            int               `yaml:"max_streams"`
+	TimestampField        string            `yaml:"timestamp_field"`
+	TenantID              string            `yaml:"tenant_id"`
+	Username              string            `yaml:"username"`
+	Password              string            `yaml:"password"`
+	BatchSize             int               `yaml:"batch_size"`
+	BatchBytes            int               `yaml:"batch_bytes"`
+	FlushInterval         int               `yaml:"flush_interval"`
+	Timeout               int               `yaml:"timeout"`
+	MaxRetries            *int              `yaml:"max_retries,omitempty"`
+	SSLCA                 string            `yaml:"ssl_ca"`
+	SSLCrt                string            `yaml:"ssl_crt"`
+	SSLKey                string            `yaml:"ssl_key"`
+	SSLInsecureSkipVerify bool              `yaml:"ssl_insecure_skip_verify"`
+	SampleSize            *int              `yaml:"sample_size,omitempty"`
+}
+
+type LokiServer struct {
+	name       string
+	config     Config
+	sender     buffer.Sender
+	client     *http.Client
+	seen       map[string]bool
+	overflowed bool
+	batches    chan *batch
+	term       chan bool
+}
+
+func init() {
+	output.Register("loki", New)
+}
+
+func New() output.Output {
+	return &LokiServer{term: make(chan bool, 1)}
+}
+
+func (l *LokiServer) ValidateConfig(config *Config) error {
+	if len(config.URL) == 0 {
+		return errors.New("Missing url")
+	}
+
+	if len(config.Labels) == 0 && len(config.StaticLabels) == 0 {
+		return errors.New("Missing labels (Loki requires at least one label)")
+	}
+
+	if (len(config.SSLCrt) > 0) != (len(config.SSLKey) > 0) {
+		return errors.New("Both ssl_crt and ssl_key are required for a client certificate")
+	}
+
+	switch l.config.Encoding {
+	case "":
+		l.config.Encoding = encodingProtobuf
+	case encodingProtobuf, encodingJSON:
+	default:
+		return fmt.Errorf("Unknown encoding %s (must be protobuf or json)", config.Encoding)
+	}
+
+	if l.config.MaxStreams <= 0 {
+		l.config.MaxStreams = defaultMaxStreams
+	}
+
+	if len(l.config.TimestampField) == 0 {
+		l.config.TimestampField = defaultTimestampField
+	}
+
+	if l.config.BatchSize <= 0 {
+		l.config.BatchSize = defaultBatchSize
+	}
+
+	if l.config.BatchBytes <= 0 {
+		l.config.BatchBytes = defaultBatchBytes
+	}
+
+	if l.config.FlushInterval <= 0 {
+		l.config.FlushInterval = defaultFlushInterval
+	}
+
+	if l.config.Timeout <= 0 {
+		l.config.Timeout = defaultTimeout
+	}
+
+	if l.config.MaxRetries == nil {
+		i := defaultMaxRetries
+		l.config.MaxRetries = &i
+	}
+
+	if l.config.SampleSize == nil {
+		i := 100
+		l.config.SampleSize = &i
+	}
+	log.Printf("[%s] Setting Sample Size to %d", l.name, *l.config.SampleSize)
+
+	return nil
+}
+
+func (l *LokiServer) Init(name string, config yaml.MapSlice, sender buffer.Sender, route route.Route) error {
+	var lokiConfig *Config
+
+	// go-yaml doesn't have a great way to partially unmarshal YAML data
+	// See https://github.com/go-yaml/yaml/issues/13
+	yamlConfig, _ := yaml.Marshal(config)
+
+	if err := yaml.Unmarshal(yamlConfig, &lokiConfig); err != nil {
+		return fmt.Errorf("Error parsing Loki config: %v", err)
+	}
+
+	l.name = name
+	l.config = *lokiConfig
+	l.sender = sender
+	l.seen = make(map[string]bool)
+
+	if err := l.ValidateConfig(lokiConfig); err != nil {
+		return fmt.Errorf("Error in config: %v", err)
+	}
+
+	return nil
+}
+
+func (l *LokiServer) tlsConfig() (*tls.Config, error) {
+	return server.ClientTLSConfig(l.config.SSLCA, l.config.SSLCrt, l.config.SSLKey, l.config.SSLInsecureSkipVerify)
+}
+
+// pusher sends batches one at a time, so entries of a stream reach Loki in
+// the order they were batched
+func (l *LokiServer) pusher() {
+	for b := range l.batches {
+		l.push(b)
+	}
+}
+
+func (l *LokiServer) Start() error {
+	if l.sender == nil {
+		log.Printf("[%s] No route is specified for this output", l.name)
+		return nil
+	}
+
+	tlsConfig, err := l.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	l.client = &http.Client{
+		Timeout: time.Duration(l.config.Timeout) * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+
+	l.batches = make(chan *batch, 1)
+	go l.pusher()
+
+	// Add the client as a subscriber
+	receiveChan := make(chan *buffer.Event, recvBuffer)
+	l.sender.AddSubscriber(l.name, receiveChan)
+	defer l.sender.DelSubscriber(l.name)
+
+	flushTick := time.NewTicker(time.Duration(l.config.FlushInterval) * time.Second)
+	defer flushTick.Stop()
+	tick := time.NewTicker(time.Duration(rateDisplayInterval) * time.Second)
+	defer tick.Stop()
+	rateCounter := ratecounter.NewRateCounter(1 * time.Second)
+
+	pending := newBatch()
+
+	log.Printf("[%s] Started Loki Output Instance", l.name)
+
+	for {
+		select {
+		case ev := <-receiveChan:
+			if server.RandInt(0, 100) >= *l.config.SampleSize {
+				continue
+			}
+			rateCounter.Incr(1)
+			pending.add(l.streamLabels(ev), entry{timestamp: l.timestamp(ev), line: *ev.Text})
+			if pending.size >= l.config.BatchSize || pending.bytes >= l.config.BatchBytes {
+				l.batches <- pending
+				pending = newBatch()
+			}
+		case <-flushTick.C:
+			if pending.size > 0 {
+				l.batches <- pending
+				pending = newBatch()
+			}
+		case <-tick.C:
+			if rateCounter.Rate() > 0 {
+				log.Printf("[%s] Current Loki output rate: %d/s\n", l.name, rateCounter.Rate())
+			}
+		case <-l.term:
+			log.Println("Loki output received term signal")
+			if pending.size > 0 {
+				l.batches <- pending
+			}
+			close(l.batches)
+			return nil
+		}
+	}
+}
+
+func (l *LokiServer) Stop() error {
+	l.term <- true
+	return nil
+}
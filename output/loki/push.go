@@ -0,0 +1,178 @@
+package loki
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// The protobuf messages of the push API are small enough to encode by hand:
+//
+//	PushRequest { repeated Stream streams = 1; }
+//	Stream      { string labels = 1; repeated Entry entries = 2; }
+//	Entry       { Timestamp timestamp = 1; string line = 2; }
+//	Timestamp   { int64 seconds = 1; int32 nanos = 2; }
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// appendBytes appends a length-delimited field
+func appendBytes(b []byte, field int, value []byte) []byte {
+	b = appendVarint(b, uint64(field<<3|2))
+	b = appendVarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func appendUint(b []byte, field int, value uint64) []byte {
+	if value == 0 {
+		return b
+	}
+	b = appendVarint(b, uint64(field<<3))
+	return appendVarint(b, value)
+}
+
+func encodeProtobuf(streams []*stream) []byte {
+	var req []byte
+
+	for _, s := range streams {
+		msg := appendBytes(nil, 1, []byte(s.key))
+
+		for _, e := range s.entries {
+			ts := appendUint(nil, 1, uint64(e.timestamp.Unix()))
+			ts = appendUint(ts, 2, uint64(e.timestamp.Nanosecond()))
+
+			en := appendBytes(nil, 1, ts)
+			en = appendBytes(en, 2, []byte(e.line))
+
+			msg = appendBytes(msg, 2, en)
+		}
+
+		req = appendBytes(req, 1, msg)
+	}
+
+	return snappy.Encode(nil, req)
+}
+
+type jsonStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+func encodeJSON(streams []*stream) ([]byte, error) {
+	req := struct {
+		Streams []jsonStream `json:"streams"`
+	}{}
+
+	for _, s := range streams {
+		js := jsonStream{Stream: s.labels}
+		for _, e := range s.entries {
+			js.Values = append(js.Values, [2]string{strconv.FormatInt(e.timestamp.UnixNano(), 10), e.line})
+		}
+		req.Streams = append(req.Streams, js)
+	}
+
+	return json.Marshal(req)
+}
+
+// retryableError marks failures worth pushing again
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (l *LokiServer) do(body []byte) error {
+	req, err := http.NewRequest("POST", l.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	if l.config.Encoding == encodingJSON {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "application/x-protobuf")
+	}
+
+	if len(l.config.TenantID) > 0 {
+		req.Header.Set("X-Scope-OrgID", l.config.TenantID)
+	}
+
+	if len(l.config.Username) > 0 {
+		req.SetBasicAuth(l.config.Username, l.config.Password)
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return &retryableError{err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("server returned %s: %s", resp.Status, bytes.TrimSpace(message))
+
+	if resp.StatusCode == 429 || resp.StatusCode >= 500 {
+		return &retryableError{err}
+	}
+
+	return err
+}
+
+// push sends a batch, retrying network errors, 429 and 5xx responses with
+// exponential backoff. Other errors, such as entries out of order or too
+// old, are not retried.
+func (l *LokiServer) push(b *batch) {
+	streams := b.sorted()
+
+	var body []byte
+	var err error
+
+	if l.config.Encoding == encodingJSON {
+		body, err = encodeJSON(streams)
+	} else {
+		body = encodeProtobuf(streams)
+	}
+
+	if err != nil {
+		log.Printf("[%s] Error encoding %d entries: %v", l.name, b.size, err)
+		return
+	}
+
+	backoff := time.Second
+
+	for attempt := 0; ; attempt++ {
+		err = l.do(body)
+		if err == nil {
+			return
+		}
+
+		if _, ok := err.(*retryableError); !ok || attempt >= *l.config.MaxRetries {
+			log.Printf("[%s] Dropping %d entries: %v", l.name, b.size, err)
+			return
+		}
+
+		log.Printf("[%s] Error pushing to Loki: %v, retrying in %s", l.name, err, backoff)
+		time.Sleep(backoff)
+		if backoff < maxRetryBackoff {
+			backoff *= 2
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package loki
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/packetzoom/logzoom/buffer"
+)
+
+// Label set to the output name when an event would otherwise have none, as
+// Loki rejects streams without labels
+const fallbackLabel = "job"
+
+// Loki label names must match [a-zA-Z_][a-zA-Z0-9_]*
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+type entry struct {
+	timestamp time.Time
+	line      string
+}
+
+type stream struct {
+	labels  map[string]string
+	key     string
+	entries []entry
+}
+
+// batch collects entries by stream until it is pushed
+type batch struct {
+	streams map[string]*stream
+	size    int
+	bytes   int
+}
+
+func newBatch() *batch {
+	return &batch{streams: make(map[string]*stream)}
+}
+
+func (b *batch) add(labels map[string]string, e entry) {
+	key := formatLabels(labels)
+
+	s, ok := b.streams[key]
+	if !ok {
+		s = &stream{labels: labels, key: key}
+		b.streams[key] = s
+	}
+
+	s.entries = append(s.entries, e)
+	b.size++
+	b.bytes += len(e.line)
+}
+
+// sorted returns the streams with their entries in timestamp order, which
+// Loki requires within a stream
+func (b *batch) sorted() []*stream {
+	streams := make([]*stream, 0, len(b.streams))
+
+	for _, s := range b.streams {
+		sort.SliceStable(s.entries, func(i, j int) bool {
+			return s.entries[i].timestamp.Before(s.entries[j].timestamp)
+		})
+		streams = append(streams, s)
+	}
+
+	return streams
+}
+
+func labelName(name string) string {
+	name = invalidLabelChars.ReplaceAllString(name, "_")
+	if len(name) > 0 && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// formatLabels renders a label set in the Prometheus text format Loki
+// expects, with names sorted so equal sets map to the same stream
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%s", name, strconv.Quote(labels[name]))
+	}
+
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// streamLabels returns the label set of an event: the static labels plus
+// the configured fields present in the event. Once max_streams label sets
+// have been seen, events for new sets only get the static labels. An empty
+// set gets the fallback label instead.
+func (l *LokiServer) streamLabels(ev *buffer.Event) map[string]string {
+	labels := l.staticLabels()
+
+	for _, field := range l.config.Labels {
+		if value, ok := ev.FieldString(field); ok && len(value) > 0 {
+			labels[labelName(field)] = value
+		}
+	}
+
+	if len(labels) == 0 {
+		labels[fallbackLabel] = l.name
+	}
+
+	key := formatLabels(labels)
+	if l.seen[key] {
+		return labels
+	}
+
+	if len(l.seen) >= l.config.MaxStreams {
+		if !l.overflowed {
+			log.Printf("[%s] Reached max_streams (%d), new label sets only get static labels", l.name, l.config.MaxStreams)
+			l.overflowed = true
+		}
+
+		labels = l.staticLabels()
+		if len(labels) == 0 {
+			labels[fallbackLabel] = l.name
+		}
+		return labels
+	}
+
+	l.seen[key] = true
+	return labels
+}
+
+func (l *LokiServer) staticLabels() map[string]string {
+	labels := make(map[string]string, len(l.config.StaticLabels)+len(l.config.Labels))
+
+	for name, value := range l.config.StaticLabels {
+		labels[labelName(name)] = value
+	}
+
+	return labels
+}
+
+// timestamp reads the event time from the timestamp field, falling back to
+// the time the event was received
+func (l *LokiServer) timestamp(ev *buffer.Event) time.Time {
+	if value, ok := ev.FieldString(l.config.TimestampField); ok {
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t
+		}
+	}
+
+	return time.Now()
+}
@@ -0,0 +1,153 @@
+package lumberjack
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/packetzoom/logzoom/buffer"
+)
+
+// client speaks the Lumberjack v2 protocol to a single host
+type client struct {
+	host      string
+	timeout   time.Duration
+	level     int
+	tlsConfig *tls.Config
+	conn      net.Conn
+}
+
+func newClient(host string, timeout time.Duration, level int, tlsConfig *tls.Config) *client {
+	return &client{
+		host:      host,
+		timeout:   timeout,
+		level:     level,
+		tlsConfig: tlsConfig,
+	}
+}
+
+func (c *client) connect() error {
+	dialer := &net.Dialer{Timeout: c.timeout}
+
+	var conn net.Conn
+	var err error
+
+	if c.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.host, c.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", c.host)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	c.conn = conn
+	return nil
+}
+
+func (c *client) close() {
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// encodeEvent builds the JSON document for a "2J" frame. The message and
+// a numeric offset are always present as the Lumberjack input relies on them.
+func encodeEvent(ev *buffer.Event) ([]byte, error) {
+	doc := make(map[string]interface{})
+
+	if ev.Fields != nil {
+		for key, value := range *ev.Fields {
+			doc[key] = value
+		}
+	}
+
+	if _, ok := doc["message"]; !ok && ev.Text != nil {
+		doc["message"] = *ev.Text
+	}
+
+	doc["offset"] = ev.Offset
+
+	return json.Marshal(doc)
+}
+
+// encodeWindow compresses a window of events into a single "2C" frame
+func (c *client) encodeWindow(events []*buffer.Event) ([]byte, error) {
+	payload := new(bytes.Buffer)
+
+	for i, ev := range events {
+		doc, err := encodeEvent(ev)
+		if err != nil {
+			return nil, err
+		}
+
+		payload.WriteString("2J")
+		binary.Write(payload, binary.BigEndian, uint32(i+1))
+		binary.Write(payload, binary.BigEndian, uint32(len(doc)))
+		payload.Write(doc)
+	}
+
+	compressed := new(bytes.Buffer)
+	w, err := zlib.NewWriterLevel(compressed, c.level)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(payload.Bytes()); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	frame := new(bytes.Buffer)
+	frame.WriteString("2W")
+	binary.Write(frame, binary.BigEndian, uint32(len(events)))
+	frame.WriteString("2C")
+	binary.Write(frame, binary.BigEndian, uint32(compressed.Len()))
+	frame.Write(compressed.Bytes())
+
+	return frame.Bytes(), nil
+}
+
+// send writes a window of count events, encoded by encodeWindow, and waits
+// until the last one is acked
+func (c *client) send(frame []byte, count int) error {
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return err
+		}
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(frame); err != nil {
+		return err
+	}
+
+	ack := make([]byte, 6)
+
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+		if _, err := io.ReadFull(c.conn, ack); err != nil {
+			return fmt.Errorf("waiting for ack: %v", err)
+		}
+
+		if string(ack[:2]) != "2A" {
+			return fmt.Errorf("unexpected response type %q", ack[:2])
+		}
+
+		// Partial acks are sent while the window is being processed
+		if binary.BigEndian.Uint32(ack[2:]) >= uint32(count) {
+			return nil
+		}
+	}
+}
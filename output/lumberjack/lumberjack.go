@@ -0,0 +1,275 @@
+package lumberjack
+
+import (
+	"compress/zlib"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/packetzoom/logzoom/buffer"
+	"github.com/packetzoom/logzoom/output"
+	"github.com/packetzoom/logzoom/route"
+	"github.com/packetzoom/logzoom/server"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	recvBuffer           = 10000
+	defaultBatchSize     = 1024
+	defaultTimeout       = 30
+	defaultFlushInterval = 1
+	maxRetryBackoff      = 60
+)
+
+type Config struct {
+	Hosts                 []string `yaml:"hosts"`
+	BatchSize             int      `yaml:"batch_size"`
+	FlushInterval         int      `yaml:"flush_interval"`
+	Timeout               int      `yaml:"timeout"`
+	CompressionLevel      *int     `yaml:"compression_level,omitempty"`
+	TLS                   bool     `yaml:"tls"`
+	SSLCA                 string   `yaml:"ssl_ca"`
+	SSLCrt                string   `yaml:"ssl_crt"`
+	SSLKey                string   `yaml:"ssl_key"`
+	SSLInsecureSkipVerify bool     `yaml:"ssl_insecure_skip_verify"`
+	SampleSize            *int     `yaml:"sample_size,omitempty"`
+}
+
+type LumberjackServer struct {
+	name    string
+	config  Config
+	sender  buffer.Sender
+	batches chan []*buffer.Event
+	workers sync.WaitGroup
+	lock    sync.RWMutex
+	done    chan bool
+	term    chan bool
+}
+
+func init() {
+	output.Register("lumberjack", New)
+}
+
+func New() output.Output {
+	return &LumberjackServer{term: make(chan bool, 1), done: make(chan bool)}
+}
+
+func (lj *LumberjackServer) ValidateConfig(config *Config) error {
+	if len(config.Hosts) == 0 {
+		return errors.New("Missing hosts")
+	}
+
+	if config.TLS && (len(config.SSLCrt) > 0) != (len(config.SSLKey) > 0) {
+		return errors.New("Both ssl_crt and ssl_key are required for a client certificate")
+	}
+
+	if lj.config.BatchSize <= 0 {
+		lj.config.BatchSize = defaultBatchSize
+	}
+
+	if lj.config.FlushInterval <= 0 {
+		lj.config.FlushInterval = defaultFlushInterval
+	}
+
+	if lj.config.Timeout <= 0 {
+		lj.config.Timeout = defaultTimeout
+	}
+
+	if lj.config.CompressionLevel == nil {
+		i := zlib.DefaultCompression
+		lj.config.CompressionLevel = &i
+	}
+
+	if lj.config.SampleSize == nil {
+		i := 100
+		lj.config.SampleSize = &i
+	}
+	log.Printf("[%s] Setting Sample Size to %d", lj.name, *lj.config.SampleSize)
+
+	return nil
+}
+
+func (lj *LumberjackServer) Init(name string, config yaml.MapSlice, sender buffer.Sender, route route.Route) error {
+	var ljConfig *Config
+
+	// go-yaml doesn't have a great way to partially unmarshal YAML data
+	// See https://github.com/go-yaml/yaml/issues/13
+	yamlConfig, _ := yaml.Marshal(config)
+
+	if err := yaml.Unmarshal(yamlConfig, &ljConfig); err != nil {
+		return fmt.Errorf("Error parsing lumberjack config: %v", err)
+	}
+
+	lj.name = name
+	lj.config = *ljConfig
+	lj.sender = sender
+
+	if err := lj.ValidateConfig(ljConfig); err != nil {
+		return fmt.Errorf("Error in config: %v", err)
+	}
+
+	return nil
+}
+
+func (lj *LumberjackServer) tlsConfig() (*tls.Config, error) {
+	if !lj.config.TLS {
+		return nil, nil
+	}
+
+	return server.ClientTLSConfig(lj.config.SSLCA, lj.config.SSLCrt, lj.config.SSLKey, lj.config.SSLInsecureSkipVerify)
+}
+
+// stopping reports whether the output is shutting down
+func (lj *LumberjackServer) stopping() bool {
+	select {
+	case <-lj.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// requeue hands a batch back to the other workers, unless they are all
+// busy or the output is shutting down
+func (lj *LumberjackServer) requeue(events []*buffer.Event) bool {
+	lj.lock.RLock()
+	defer lj.lock.RUnlock()
+
+	if lj.stopping() {
+		return false
+	}
+
+	select {
+	case lj.batches <- events:
+		return true
+	default:
+		return false
+	}
+}
+
+// worker sends batches to a single host. Batches from a failed host are
+// handed back to the other workers when possible, so load is balanced
+// across all healthy hosts. Batches that can't be encoded are dropped, and
+// at shutdown a batch is dropped after its first failed attempt.
+func (lj *LumberjackServer) worker(c *client) {
+	defer lj.workers.Done()
+	defer c.close()
+
+	backoff := 1
+
+	for events := range lj.batches {
+		frame, err := c.encodeWindow(events)
+		if err != nil {
+			log.Printf("[%s] Dropping %d events that can't be encoded: %v", lj.name, len(events), err)
+			continue
+		}
+
+		for {
+			err := c.send(frame, len(events))
+			if err == nil {
+				backoff = 1
+				break
+			}
+
+			log.Printf("[%s] Error sending %d events to %s: %v", lj.name, len(events), c.host, err)
+			c.close()
+
+			if lj.stopping() {
+				log.Printf("[%s] Dropping %d events at shutdown", lj.name, len(events))
+				break
+			}
+
+			requeued := len(lj.config.Hosts) > 1 && lj.requeue(events)
+
+			select {
+			case <-time.After(time.Duration(backoff) * time.Second):
+			case <-lj.done:
+			}
+			if backoff < maxRetryBackoff {
+				backoff *= 2
+			}
+
+			if requeued {
+				break
+			}
+		}
+	}
+}
+
+func (lj *LumberjackServer) Start() error {
+	if lj.sender == nil {
+		log.Printf("[%s] No route is specified for this output", lj.name)
+		return nil
+	}
+
+	tlsConfig, err := lj.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Duration(lj.config.Timeout) * time.Second
+	lj.batches = make(chan []*buffer.Event, len(lj.config.Hosts))
+
+	for _, host := range lj.config.Hosts {
+		lj.workers.Add(1)
+		go lj.worker(newClient(host, timeout, *lj.config.CompressionLevel, tlsConfig))
+	}
+
+	// Add the client as a subscriber
+	receiveChan := make(chan *buffer.Event, recvBuffer)
+	lj.sender.AddSubscriber(lj.name, receiveChan)
+	defer lj.sender.DelSubscriber(lj.name)
+
+	tick := time.NewTicker(time.Duration(lj.config.FlushInterval) * time.Second)
+	defer tick.Stop()
+
+	events := make([]*buffer.Event, 0, lj.config.BatchSize)
+
+	log.Printf("[%s] Started Lumberjack Output Instance", lj.name)
+
+	for {
+		select {
+		case ev := <-receiveChan:
+			if server.RandInt(0, 100) < *lj.config.SampleSize {
+				events = append(events, ev)
+			}
+			if len(events) >= lj.config.BatchSize {
+				lj.batches <- events
+				events = make([]*buffer.Event, 0, lj.config.BatchSize)
+			}
+		case <-tick.C:
+			if len(events) > 0 {
+				lj.batches <- events
+				events = make([]*buffer.Event, 0, lj.config.BatchSize)
+			}
+		case <-lj.term:
+			log.Println("Lumberjack output received term signal")
+			if len(events) > 0 {
+				lj.batches <- events
+			}
+
+			// Workers finish the queued batches, then exit. Stop has
+			// closed done, so they no longer requeue into batches.
+			close(lj.batches)
+
+			lj.workers.Wait()
+			return nil
+		}
+	}
+}
+
+// Stop cuts the backoff of the workers short, so Start can hand over its
+// last batch without waiting for a retry
+func (lj *LumberjackServer) Stop() error {
+	lj.lock.Lock()
+	defer lj.lock.Unlock()
+
+	if !lj.stopping() {
+		close(lj.done)
+		lj.term <- true
+	}
+	return nil
+}
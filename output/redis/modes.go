@@ -0,0 +1,89 @@
+package redis
+
+import (
+	"log"
+	"time"
+
+	goredis "github.com/go-redis/redis"
+)
+
+const (
+	modeRedisMQ = "redismq"
+	modeList    = "list"
+	modePubSub  = "pubsub"
+	modeStream  = "stream"
+
+	defaultMessageField = "message"
+)
+
+// publish sends an event to subscribers of the channel straight away
+func (redisQueue *RedisQueue) publish(text string) error {
+	err := redisQueue.client.Publish(redisQueue.key, text).Err()
+
+	if err != nil {
+		log.Println("Error publishing data: ", err)
+	}
+
+	return err
+}
+
+// flushPending writes buffered events, in a single round trip with RPUSH
+// in list mode or XADD in stream mode, and one at a time in redismq mode.
+// After a failure it backs off, doubling the delay up to maxFlushBackoff,
+// before trying again.
+func (redisQueue *RedisQueue) flushPending() error {
+	if len(redisQueue.pending) == 0 || time.Now().Before(redisQueue.retryAt) {
+		return nil
+	}
+
+	var err error
+
+	switch redisQueue.config.Mode {
+	case modeRedisMQ:
+		for i, text := range redisQueue.pending {
+			if err = redisQueue.queue.Put(text); err != nil {
+				// Keep only the events that were not written
+				redisQueue.pending = redisQueue.pending[i:]
+				break
+			}
+		}
+	case modeList:
+		values := make([]interface{}, len(redisQueue.pending))
+		for i, text := range redisQueue.pending {
+			values[i] = text
+		}
+		err = redisQueue.client.RPush(redisQueue.key, values...).Err()
+	default:
+		pipe := redisQueue.client.Pipeline()
+		for _, text := range redisQueue.pending {
+			pipe.XAdd(&goredis.XAddArgs{
+				Stream:       redisQueue.key,
+				MaxLenApprox: redisQueue.config.StreamMaxLen,
+				Values:       map[string]interface{}{redisQueue.config.MessageField: text},
+			})
+		}
+		_, err = pipe.Exec()
+	}
+
+	if err != nil {
+		redisQueue.backoff *= 2
+		if redisQueue.backoff < minFlushBackoff {
+			redisQueue.backoff = minFlushBackoff
+		} else if redisQueue.backoff > maxFlushBackoff {
+			redisQueue.backoff = maxFlushBackoff
+		}
+		redisQueue.retryAt = time.Now().Add(redisQueue.backoff)
+
+		log.Printf("Error flushing %d events to Redis: %s, retrying in %s", len(redisQueue.pending), err, redisQueue.backoff)
+		return err
+	}
+
+	if redisQueue.dropped > 0 {
+		log.Printf("Dropped %d events for %s while Redis was unavailable", redisQueue.dropped, redisQueue.key)
+		redisQueue.dropped = 0
+	}
+
+	redisQueue.backoff = 0
+	redisQueue.pending = redisQueue.pending[:0]
+	return nil
+}
@@ -8,8 +8,10 @@ import (
 	"time"
 
 	"github.com/adjust/redismq"
+	goredis "github.com/go-redis/redis"
 	"github.com/packetzoom/logzoom/buffer"
 	"github.com/packetzoom/logzoom/output"
+	"github.com/packetzoom/logzoom/redisconn"
 	"github.com/packetzoom/logzoom/server"
 	"github.com/packetzoom/logzoom/route"
 	"github.com/paulbellamy/ratecounter"
@@ -18,61 +20,108 @@ import (
 )
 
 const (
-	redisFlushInterval  = 5
-	rateDisplayInterval = 10
-	recvBuffer          = 10000
+	redisFlushInterval    = 5
+	rateDisplayInterval   = 10
+	recvBuffer            = 10000
+	defaultMaxQueues      = 100
+	maxPending            = 10 * recvBuffer
+	minFlushBackoff       = 1 * time.Second
+	maxFlushBackoff       = 60 * time.Second
+	sentinelCheckInterval = 5
 )
 
 type Config struct {
-	Host       string   `yaml:"host"`
-	Port       int      `yaml:"port"`
-	Db         int64    `yaml:"db"`
-	Password   string   `yaml:"password"`
-	CopyQueues []string `yaml:"copy_queues"`
-	SampleSize *int     `yaml:"sample_size,omitempty"`
+	redisconn.Config `yaml:",inline"`
+	CopyQueues       []string `yaml:"copy_queues"`
+	FallbackQueue    string   `yaml:"fallback_queue"`
+	MaxQueues        int      `yaml:"max_queues"`
+	Mode             string   `yaml:"mode"`
+	StreamMaxLen     int64    `yaml:"stream_maxlen"`
+	MessageField     string   `yaml:"message_field"`
+	SampleSize       *int     `yaml:"sample_size,omitempty"`
 }
 
 type RedisServer struct {
 	name   string
-	fields map[string]string
 	config Config
 	sender buffer.Sender
+	client goredis.UniversalClient
+	queues map[string]*RedisQueue
 	term   chan bool
 }
 
 type RedisQueue struct {
-	queue  *redismq.BufferedQueue
-	data   chan string
-	term   chan bool
-	ticker time.Ticker
+	config    Config
+	key       string
+	queue     *redismq.Queue
+	client    goredis.UniversalClient
+	pending   []string
+	dropped   int
+	backoff   time.Duration
+	retryAt   time.Time
+	data      chan string
+	reconnect chan Config
+	term      chan bool
+	done      chan bool
+	ticker    time.Ticker
 }
 
-func NewRedisQueue(config Config, key string) *RedisQueue {
-	port := strconv.Itoa(config.Port)
+// NewRedisQueue creates the queue for a key. The list, pubsub and stream
+// modes share the client of the output, while redismq queues connect to
+// config.Host and config.Port.
+func NewRedisQueue(config Config, key string, client goredis.UniversalClient) *RedisQueue {
+	redisQueue := &RedisQueue{config: config,
+		key:       key,
+		client:    client,
+		data:      make(chan string),
+		reconnect: make(chan Config),
+		term:      make(chan bool),
+		done:      make(chan bool),
+		ticker:    *time.NewTicker(time.Duration(redisFlushInterval) * time.Second)}
+
+	if config.Mode == modeRedisMQ {
+		redisQueue.queue = newQueue(config, key)
+	}
 
-	queue := redismq.CreateBufferedQueue(config.Host,
-		port,
+	return redisQueue
+}
+
+// newQueue opens a redismq queue. Events are buffered in pending rather
+// than in a redismq BufferedQueue, whose background writer can't be stopped
+// when the queue moves to a new master.
+func newQueue(config Config, key string) *redismq.Queue {
+	return redismq.CreateQueue(config.Host,
+		strconv.Itoa(config.Port),
 		config.Password,
 		config.Db,
-		key,
-		recvBuffer)
-	queue.Start()
+		key)
+}
 
-	return &RedisQueue{queue: queue,
-		data:   make(chan string),
-		term:   make(chan bool),
-		ticker: *time.NewTicker(time.Duration(redisFlushInterval) * time.Second)}
+// moveTo switches a redismq queue to a new master. Pending events are
+// written to the new master straight away rather than after the backoff
+// of a failed flush to the old one.
+func (redisQueue *RedisQueue) moveTo(config Config) {
+	redisQueue.config = config
+	redisQueue.queue = newQueue(config, redisQueue.key)
+	redisQueue.backoff = 0
+	redisQueue.retryAt = time.Time{}
 }
 
 func (redisQueue *RedisQueue) insertToRedis(text string) error {
-	err := redisQueue.queue.Put(text)
+	if redisQueue.config.Mode == modePubSub {
+		return redisQueue.publish(text)
+	}
 
-	if err != nil {
-		fmt.Println("Error inserting data: ", err)
-		return err
+	redisQueue.pending = append(redisQueue.pending, text)
+
+	// Drop the oldest events rather than grow without limit while Redis is
+	// unavailable
+	if over := len(redisQueue.pending) - maxPending; over > 0 {
+		redisQueue.pending = redisQueue.pending[over:]
+		redisQueue.dropped += over
 	}
 
-	if len(redisQueue.queue.Buffer) > recvBuffer {
+	if len(redisQueue.pending) > recvBuffer {
 		return redisQueue.flushQueue()
 	}
 
@@ -80,14 +129,15 @@ func (redisQueue *RedisQueue) insertToRedis(text string) error {
 }
 
 func (redisQueue *RedisQueue) flushQueue() error {
-	if len(redisQueue.queue.Buffer) > 0 {
-		//	log.Printf("Flushing %d events to Redis", len(redisQueue.queue.Buffer))
+	if redisQueue.config.Mode == modePubSub {
+		return nil
 	}
 
-	redisQueue.queue.FlushBuffer()
-	return nil
+	return redisQueue.flushPending()
 }
 
+// Start writes the events of the queue until a term signal, then makes a
+// last attempt to flush them and closes done
 func (redisQueue *RedisQueue) Start() {
 	for {
 		select {
@@ -95,11 +145,28 @@ func (redisQueue *RedisQueue) Start() {
 			redisQueue.insertToRedis(text)
 		case <-redisQueue.ticker.C:
 			redisQueue.flushQueue()
+		case config := <-redisQueue.reconnect:
+			redisQueue.moveTo(config)
 		case <-redisQueue.term:
+			redisQueue.drain()
+			redisQueue.retryAt = time.Time{}
 			redisQueue.flushQueue()
+			close(redisQueue.done)
+			return
 		}
 	}
+}
 
+// drain takes the events still waiting to be handed to the queue
+func (redisQueue *RedisQueue) drain() {
+	for {
+		select {
+		case text := <-redisQueue.data:
+			redisQueue.insertToRedis(text)
+		default:
+			return
+		}
+	}
 }
 
 func init() {
@@ -111,18 +178,39 @@ func New() output.Output {
 }
 
 func (redisServer *RedisServer) ValidateConfig(config *Config) error {
-	if len(config.Host) == 0 {
-		return errors.New("Missing Redis host")
-	}
-
-	if config.Port <= 0 {
-		return errors.New("Missing Redis port")
+	if err := config.Validate(); err != nil {
+		return err
 	}
 
 	if len(config.CopyQueues) == 0 {
 		return errors.New("Missing Redis output queues")
 	}
 
+	switch redisServer.config.Mode {
+	case "":
+		redisServer.config.Mode = modeRedisMQ
+	case modeRedisMQ, modeList, modePubSub, modeStream:
+	default:
+		return fmt.Errorf("Unknown Redis mode %s", config.Mode)
+	}
+
+	if redisServer.config.Mode == modeRedisMQ {
+		if len(config.ClusterAddrs) > 0 {
+			return errors.New("Redis Cluster requires the list, pubsub or stream mode")
+		}
+		if config.TLS {
+			return errors.New("TLS requires the list, pubsub or stream mode")
+		}
+	}
+
+	if len(redisServer.config.MessageField) == 0 {
+		redisServer.config.MessageField = defaultMessageField
+	}
+
+	if redisServer.config.MaxQueues <= 0 {
+		redisServer.config.MaxQueues = defaultMaxQueues
+	}
+
 	if redisServer.config.SampleSize == nil {
 		i := 100
 		redisServer.config.SampleSize = &i
@@ -144,7 +232,6 @@ func (redisServer *RedisServer) Init(name string, config yaml.MapSlice, sender b
 	}
 
 	redisServer.name = name
-	redisServer.fields = route.Fields
 	redisServer.config = *redisConfig
 	redisServer.sender = sender
 
@@ -155,6 +242,67 @@ func (redisServer *RedisServer) Init(name string, config yaml.MapSlice, sender b
 	return nil
 }
 
+// queue returns the Redis queue for a key, creating it on first use
+func (redisServer *RedisServer) queue(key string) *RedisQueue {
+	if redisQueue, ok := redisServer.queues[key]; ok {
+		return redisQueue
+	}
+
+	redisQueue := NewRedisQueue(redisServer.config, key, redisServer.client)
+	redisServer.queues[key] = redisQueue
+	go redisQueue.Start()
+
+	return redisQueue
+}
+
+// eventQueues resolves the copy queue templates for an event. Events
+// missing a referenced field, or that would create more than max_queues
+// queues, go to the fallback queue if one is configured.
+func (redisServer *RedisServer) eventQueues(ev *buffer.Event) []*RedisQueue {
+	queues := make([]*RedisQueue, 0, len(redisServer.config.CopyQueues))
+
+	for _, template := range redisServer.config.CopyQueues {
+		key, err := ev.Expand(template)
+
+		if err == nil {
+			if _, ok := redisServer.queues[key]; !ok && len(redisServer.queues) >= redisServer.config.MaxQueues {
+				err = fmt.Errorf("too many queues (max_queues is %d)", redisServer.config.MaxQueues)
+			}
+		}
+
+		if err != nil {
+			if len(redisServer.config.FallbackQueue) == 0 {
+				log.Printf("[%s] Dropping event for queue %s: %v", redisServer.name, template, err)
+				continue
+			}
+			key = redisServer.config.FallbackQueue
+		}
+
+		queues = append(queues, redisServer.queue(key))
+	}
+
+	return queues
+}
+
+// checkMaster moves the redismq queues over when Sentinel reports a new
+// master, so writes resume there after a failover
+func (redisServer *RedisServer) checkMaster() {
+	host, port, err := redisconn.MasterAddr(redisServer.config.Config)
+	if err != nil || (host == redisServer.config.Host && port == redisServer.config.Port) {
+		return
+	}
+
+	log.Printf("[%s] Redis master moved from %s:%d to %s:%d", redisServer.name,
+		redisServer.config.Host, redisServer.config.Port, host, port)
+
+	redisServer.config.Host = host
+	redisServer.config.Port = port
+
+	for _, queue := range redisServer.queues {
+		queue.reconnect <- redisServer.config
+	}
+}
+
 func (redisServer *RedisServer) Start() error {
 	if (redisServer.sender == nil) {
 		log.Printf("[%s] No Route is specified for this output", redisServer.name)
@@ -165,35 +313,49 @@ func (redisServer *RedisServer) Start() error {
 	redisServer.sender.AddSubscriber(redisServer.name, receiveChan)
 	defer redisServer.sender.DelSubscriber(redisServer.name)
 
-	allQueues := make([]*RedisQueue, len(redisServer.config.CopyQueues))
+	redisServer.queues = make(map[string]*RedisQueue)
+
+	if redisServer.config.Mode == modeRedisMQ {
+		host, port, err := redisconn.MasterAddr(redisServer.config.Config)
+
+		for err != nil {
+			log.Printf("[%s] Error finding Redis master: %s, sleeping", redisServer.name, err)
+			time.Sleep(2 * time.Second)
+			host, port, err = redisconn.MasterAddr(redisServer.config.Config)
+		}
+
+		redisServer.config.Host = host
+		redisServer.config.Port = port
+	} else {
+		client, err := redisconn.NewClient(redisServer.config.Config)
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+		redisServer.client = client
+	}
 
-	// Create Redis queue
-	for index, key := range redisServer.config.CopyQueues {
-		redisQueue := NewRedisQueue(redisServer.config, key)
-		allQueues[index] = redisQueue
-		go redisQueue.Start()
+	// Create the Redis queues that don't depend on event fields
+	for _, key := range redisServer.config.CopyQueues {
+		if !buffer.HasFieldReferences(key) {
+			redisServer.queue(key)
+		}
 	}
 
 	log.Printf("[%s] Started Redis Output Instance", redisServer.name)
 	// Loop events and publish to Redis
 	tick := time.NewTicker(time.Duration(redisFlushInterval) * time.Second)
+	sentinelTick := time.NewTicker(time.Duration(sentinelCheckInterval) * time.Second)
+	defer sentinelTick.Stop()
 	rateCounter := ratecounter.NewRateCounter(1 * time.Second)
 
 	for {
 		select {
 		case ev := <-receiveChan:
 			rateCounter.Incr(1)
-			var allowed bool
-			allowed = true
-			for key, value :=  range redisServer.fields {
-				if ((*ev.Fields)[key] == nil || ((*ev.Fields)[key] != nil && value != (*ev.Fields)[key].(string))) {
-					allowed = false
-					break
-				}
-			}
-			if allowed && server.RandInt(0, 100) < *redisServer.config.SampleSize {
+			if server.RandInt(0, 100) < *redisServer.config.SampleSize {
 				text := *ev.Text
-				for _, queue := range allQueues {
+				for _, queue := range redisServer.eventQueues(ev) {
 					queue.data <- text
 				}
 			}
@@ -201,12 +363,21 @@ func (redisServer *RedisServer) Start() error {
 			if rateCounter.Rate() > 0 {
 				log.Printf("[%s] Current Redis input rate: %d/s\n", redisServer.name, rateCounter.Rate())
 			}
+		case <-sentinelTick.C:
+			if redisServer.config.Mode == modeRedisMQ && len(redisServer.config.SentinelMaster) > 0 {
+				redisServer.checkMaster()
+			}
 		case <-redisServer.term:
 			log.Println("RedisServer received term signal")
-			for _, queue := range allQueues {
+			for _, queue := range redisServer.queues {
 				queue.term <- true
 			}
 
+			// The client is closed once every queue is flushed
+			for _, queue := range redisServer.queues {
+				<-queue.done
+			}
+
 			return nil
 		}
 	}
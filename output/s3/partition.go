@@ -0,0 +1,83 @@
+package s3
+
+import (
+	"strings"
+
+	"github.com/packetzoom/logzoom/buffer"
+)
+
+const defaultMaxOpenFiles = 100
+
+// keyVariables are the placeholders of aws_s3_output_key resolved at upload
+// time. They take precedence over event fields of the same name.
+var keyVariables = map[string]bool{
+	"path":      true,
+	"timeSlice": true,
+	"hostname":  true,
+	"uuid":      true,
+}
+
+// partitionValue keeps a field value within one level of the key, as
+// Hive-style partitions such as log_type=%{log_type} expect
+func partitionValue(value string) string {
+	return strings.Replace(value, "/", "_", -1)
+}
+
+// partitionKey resolves the event fields referenced by a key template,
+// leaving the upload-time variables in place. Events with the same
+// partition key are written to the same file.
+func partitionKey(template string, ev *buffer.Event) (string, error) {
+	return buffer.ExpandFields(template, func(key string) (string, bool) {
+		if keyVariables[key] {
+			return "%{" + key + "}", true
+		}
+		value, ok := ev.FieldString(key)
+		return partitionValue(value), ok
+	})
+}
+
+// hasFieldReferences reports whether a key template refers to event fields
+// besides the upload-time variables
+func hasFieldReferences(template string) bool {
+	_, err := buffer.ExpandFields(template, func(key string) (string, bool) {
+		return "", keyVariables[key]
+	})
+	return err != nil
+}
+
+// partition returns the key template of an event: aws_s3_output_key with
+// its fields resolved, or fallback_output_key when the event lacks one
+func (s3Writer *S3Writer) partition(ev *buffer.Event) (string, error) {
+	key, err := partitionKey(s3Writer.Config.AwsS3OutputKey, ev)
+	if err != nil && len(s3Writer.Config.FallbackOutputKey) > 0 {
+		return partitionKey(s3Writer.Config.FallbackOutputKey, ev)
+	}
+	return key, err
+}
+
+// fileSaver returns the file saver of a partition, uploading the least
+// recently written file when max_open_files would be exceeded
+func (s3Writer *S3Writer) fileSaver(savers map[string]*FileSaver, key string) *FileSaver {
+	if fileSaver, ok := savers[key]; ok {
+		return fileSaver
+	}
+
+	if len(savers) >= s3Writer.Config.MaxOpenFiles {
+		var oldest *FileSaver
+		for _, fileSaver := range savers {
+			if oldest == nil || fileSaver.LastWrite.Before(oldest.LastWrite) {
+				oldest = fileSaver
+			}
+		}
+		s3Writer.InitiateUploadToS3(oldest)
+		delete(savers, oldest.Key)
+	}
+
+	fileSaver := &FileSaver{
+		Config:      s3Writer.Config,
+		Key:         key,
+		RateCounter: s3Writer.rateCounter,
+	}
+	savers[key] = fileSaver
+	return fileSaver
+}
@@ -0,0 +1,198 @@
+package s3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const quarantineDir = "quarantine"
+
+// isLocalFile reports whether a file in local_path belongs to this output.
+// Besides <output>-<digits>, it accepts the <output><digits> names used by
+// earlier releases, so their leftovers are recovered after an upgrade.
+func (s3Writer *S3Writer) isLocalFile(name string) bool {
+	for _, prefix := range []string{tempPrefix(s3Writer.name), s3Writer.name} {
+		if strings.HasPrefix(name, prefix) && isDigits(name[len(prefix):]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isDigits(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// RecoverLocalFiles uploads the files a previous run left in local_path:
+// files whose upload failed, and files that were being written when the
+// process stopped. Files that can't be read are moved to the quarantine
+// directory of local_path.
+func (s3Writer *S3Writer) RecoverLocalFiles() {
+	files, err := ioutil.ReadDir(s3Writer.Config.LocalPath)
+	if err != nil {
+		log.Printf("[%s] Error reading %s: %v", s3Writer.name, s3Writer.Config.LocalPath, err)
+		return
+	}
+
+	for _, info := range files {
+		if info.IsDir() || !s3Writer.isLocalFile(info.Name()) {
+			continue
+		}
+
+		path := filepath.Join(s3Writer.Config.LocalPath, info.Name())
+
+		if info.Size() == 0 {
+			os.Remove(path)
+			continue
+		}
+
+		fileInfo, err := s3Writer.finalise(path)
+		if err != nil {
+			log.Printf("[%s] Error recovering %s: %v", s3Writer.name, path, err)
+			s3Writer.quarantine(path)
+			continue
+		}
+
+		os.Remove(path)
+
+		if fileInfo.Count == 0 {
+			os.Remove(fileInfo.Filename)
+			continue
+		}
+
+		log.Printf("[%s] Recovered %d events from %s", s3Writer.name, fileInfo.Count, path)
+		s3Writer.uploadChannel <- fileInfo
+	}
+}
+
+// finalise copies the events of a leftover file into a new, complete gzip
+// file. A file cut short by a crash has no gzip trailer; the events read
+// before the cut are kept.
+func (s3Writer *S3Writer) finalise(path string) (OutputFileInfo, error) {
+	var fileInfo OutputFileInfo
+
+	in, err := os.Open(path)
+	if err != nil {
+		return fileInfo, err
+	}
+	defer in.Close()
+
+	reader, err := gzip.NewReader(in)
+	if err != nil {
+		return fileInfo, err
+	}
+
+	key, err := s3Writer.recoveredKey(reader.Header.Comment)
+	if err != nil {
+		return fileInfo, err
+	}
+
+	out, err := ioutil.TempFile(s3Writer.Config.LocalPath, tempPrefix(s3Writer.name))
+	if err != nil {
+		return fileInfo, err
+	}
+
+	writer := gzip.NewWriter(out)
+	writer.Header.Comment = url.QueryEscape(key)
+	counter := &lineCounter{}
+
+	_, err = io.Copy(io.MultiWriter(writer, counter), reader)
+	if err == io.ErrUnexpectedEOF {
+		log.Printf("[%s] %s is truncated, keeping the events before the cut", s3Writer.name, path)
+		err = nil
+	}
+
+	// A cut may fall in the middle of an event
+	if err == nil && counter.bytes > 0 && !counter.newline {
+		_, err = writer.Write([]byte("\n"))
+		counter.lines++
+	}
+
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(out.Name())
+		return fileInfo, err
+	}
+
+	fileInfo.Filename = out.Name()
+	fileInfo.Key = key
+	fileInfo.Count = counter.lines
+	fileInfo.Bytes = counter.bytes
+	return fileInfo, nil
+}
+
+// recoveredKey returns the key template of a leftover file, as escaped in
+// its gzip header. Files written before partitioning have none, and get the
+// output key unless it refers to event fields.
+func (s3Writer *S3Writer) recoveredKey(comment string) (string, error) {
+	switch {
+	case len(comment) > 0:
+		return url.QueryUnescape(comment)
+	case !hasFieldReferences(s3Writer.Config.AwsS3OutputKey):
+		return s3Writer.Config.AwsS3OutputKey, nil
+	case len(s3Writer.Config.FallbackOutputKey) > 0:
+		return s3Writer.Config.FallbackOutputKey, nil
+	}
+
+	return "", errors.New("no key for the partition of the file")
+}
+
+// quarantine moves a file that can't be recovered out of the way, keeping
+// it for inspection
+func (s3Writer *S3Writer) quarantine(path string) {
+	dir := filepath.Join(s3Writer.Config.LocalPath, quarantineDir)
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Printf("[%s] Error creating %s: %v", s3Writer.name, dir, err)
+		return
+	}
+
+	dest := filepath.Join(dir, filepath.Base(path))
+	if err := os.Rename(path, dest); err != nil {
+		log.Printf("[%s] Error moving %s to %s: %v", s3Writer.name, path, dest, err)
+		return
+	}
+
+	log.Printf("[%s] Moved unreadable file %s to %s", s3Writer.name, path, dest)
+}
+
+// lineCounter counts the events copied from a leftover file
+type lineCounter struct {
+	lines   int
+	bytes   int64
+	newline bool
+}
+
+func (c *lineCounter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		c.lines += bytes.Count(p, []byte("\n"))
+		c.bytes += int64(len(p))
+		c.newline = p[len(p)-1] == '\n'
+	}
+	return len(p), nil
+}
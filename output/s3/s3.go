@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/url"
 	"os"
 	"strings"
 	"time"
@@ -31,6 +32,9 @@ const (
 	s3FlushInterval        = 10
 	recvBuffer             = 10000
 	maxSimultaneousUploads = 8
+	rotateCheckInterval    = 1
+	minUploadBackoff       = 1 * time.Second
+	maxUploadBackoff       = 5 * time.Minute
 )
 
 func uuid() string {
@@ -47,37 +51,59 @@ type Config struct {
 	AwsS3Bucket string `yaml:"aws_s3_bucket"`
 	AwsS3Region string `yaml:"aws_s3_region"`
 
-	LocalPath       string `yaml:"local_path"`
-	Path            string `yaml:"s3_path"`
-	TimeSliceFormat string `yaml:"time_slice_format"`
-	AwsS3OutputKey  string `yaml:"aws_s3_output_key"`
-	SampleSize      *int   `yaml:"sample_size,omitempty"`
+	LocalPath         string `yaml:"local_path"`
+	Path              string `yaml:"s3_path"`
+	TimeSliceFormat   string `yaml:"time_slice_format"`
+	AwsS3OutputKey    string `yaml:"aws_s3_output_key"`
+	FallbackOutputKey string `yaml:"fallback_output_key"`
+	MaxOpenFiles      int    `yaml:"max_open_files"`
+	MaxSize           int64  `yaml:"max_size"`
+	MaxEvents         int    `yaml:"max_events"`
+	MaxAge            int    `yaml:"max_age"`
+	SampleSize        *int   `yaml:"sample_size,omitempty"`
 }
 
 type OutputFileInfo struct {
 	Filename string
+	Key      string
 	Count    int
+	Bytes    int64
+	Created  time.Time
 }
 
 type FileSaver struct {
 	Config      Config
+	Key         string
+	File        *os.File
 	Writer      *gzip.Writer
 	FileInfo    OutputFileInfo
+	LastWrite   time.Time
 	RateCounter *ratecounter.RateCounter
 }
 
+// tempPrefix is the prefix of the local files of an output. The files are
+// named <output>-<digits>, which tells apart the files of outputs sharing
+// local_path when recovering them.
+func tempPrefix(name string) string {
+	return name + "-"
+}
+
 func (fileSaver *FileSaver) WriteToFile(name string, event *buffer.Event) error {
 	if fileSaver.Writer == nil {
 		log.Println("Creating new S3 gzip writer")
-		file, err := ioutil.TempFile(fileSaver.Config.LocalPath, name)
+		file, err := ioutil.TempFile(fileSaver.Config.LocalPath, tempPrefix(name))
 
 		if err != nil {
-			log.Printf("Error creating temporary file:", err)
+			log.Println("Error creating temporary file:", err)
+			return err
 		}
 
+		fileSaver.File = file
 		fileSaver.Writer = gzip.NewWriter(file)
-		fileSaver.FileInfo.Filename = file.Name()
-		fileSaver.FileInfo.Count = 0
+		// Kept in the file, so the key is known when recovering it. Gzip
+		// header strings must be Latin-1 without NUL, so the key is escaped.
+		fileSaver.Writer.Header.Comment = url.QueryEscape(fileSaver.Key)
+		fileSaver.FileInfo = OutputFileInfo{Filename: file.Name(), Key: fileSaver.Key, Created: time.Now()}
 	}
 
 	text := *event.Text
@@ -96,19 +122,45 @@ func (fileSaver *FileSaver) WriteToFile(name string, event *buffer.Event) error
 	}
 
 	fileSaver.FileInfo.Count += 1
+	fileSaver.FileInfo.Bytes += int64(len(text)) + 1
+	fileSaver.LastWrite = time.Now()
 	fileSaver.RateCounter.Incr(1)
 
 	return nil
 }
 
+// Full reports whether the current file reached max_size bytes (before
+// compression) or max_events events
+func (fileSaver *FileSaver) Full() bool {
+	if fileSaver.Writer == nil {
+		return false
+	}
+
+	if fileSaver.Config.MaxSize > 0 && fileSaver.FileInfo.Bytes >= fileSaver.Config.MaxSize {
+		return true
+	}
+
+	return fileSaver.Config.MaxEvents > 0 && fileSaver.FileInfo.Count >= fileSaver.Config.MaxEvents
+}
+
+// Expired reports whether the current file is older than max_age seconds
+func (fileSaver *FileSaver) Expired() bool {
+	if fileSaver.Writer == nil {
+		return false
+	}
+
+	return time.Since(fileSaver.FileInfo.Created) >= time.Duration(fileSaver.Config.MaxAge)*time.Second
+}
+
 func (s3Writer *S3Writer) doUpload(fileInfo OutputFileInfo) error {
 	log.Printf("Opening file %s\n", fileInfo.Filename)
 	reader, err := os.Open(fileInfo.Filename)
 
 	if err != nil {
-		log.Printf("Failed to open file:", err)
+		log.Println("Failed to open file:", err)
 		return err
 	}
+	defer reader.Close()
 
 	curTime := time.Now()
 	hostname, _ := os.Hostname()
@@ -121,7 +173,7 @@ func (s3Writer *S3Writer) doUpload(fileInfo OutputFileInfo) error {
 		"uuid":      uuid(),
 	}
 
-	destFile := s3Writer.Config.AwsS3OutputKey
+	destFile := fileInfo.Key
 
 	for key, value := range valuesForKey {
 		expr := "%{" + key + "}"
@@ -139,43 +191,71 @@ func (s3Writer *S3Writer) doUpload(fileInfo OutputFileInfo) error {
 		log.Printf("%d events written to S3 %s", fileInfo.Count, result.Location)
 		os.Remove(fileInfo.Filename)
 	} else {
-		log.Printf("Error uploading to S3", s3Error)
+		log.Println("Error uploading to S3:", s3Error)
 	}
 
 	return s3Error
 
 }
 
+// WaitForUpload uploads the files handed over by the writer. A failed
+// upload is retried, doubling the delay up to maxUploadBackoff; the file
+// stays in local_path meanwhile, so it is also recovered after a restart.
 func (s3Writer *S3Writer) WaitForUpload() {
-	for {
-		select {
-		case fileInfo := <-s3Writer.uploadChannel:
-			s3Writer.doUpload(fileInfo)
+	for fileInfo := range s3Writer.uploadChannel {
+		backoff := minUploadBackoff
+
+		for {
+			err := s3Writer.doUpload(fileInfo)
+			if err == nil || os.IsNotExist(err) {
+				break
+			}
+
+			log.Printf("[%s] Retrying upload of %s in %s", s3Writer.name, fileInfo.Filename, backoff)
+			time.Sleep(backoff)
+
+			backoff *= 2
+			if backoff > maxUploadBackoff {
+				backoff = maxUploadBackoff
+			}
 		}
 	}
 }
 
+// Close finishes the current file and returns it
+func (fileSaver *FileSaver) Close() OutputFileInfo {
+	writer := fileSaver.Writer
+	file := fileSaver.File
+	fileInfo := fileSaver.FileInfo
+	fileSaver.Writer = nil
+	fileSaver.File = nil
+
+	if err := writer.Close(); err != nil {
+		log.Println("Error closing gzip writer:", err)
+	}
+	if err := file.Close(); err != nil {
+		log.Println("Error closing file:", err)
+	}
+
+	return fileInfo
+}
+
 func (s3Writer *S3Writer) InitiateUploadToS3(fileSaver *FileSaver) {
 	if fileSaver.Writer == nil {
 		return
 	}
 
 	log.Printf("Upload to S3, current event rate: %d/s\n", fileSaver.RateCounter.Rate())
-	writer := fileSaver.Writer
-	fileInfo := fileSaver.FileInfo
-	fileSaver.Writer = nil
-	writer.Close()
-
-	s3Writer.uploadChannel <- fileInfo
+	s3Writer.uploadChannel <- fileSaver.Close()
 }
 
 type S3Writer struct {
 	name          string
-	fields        map[string]string
 	Config        Config
 	Sender        buffer.Sender
 	S3Uploader    *s3manager.Uploader
 	uploadChannel chan OutputFileInfo
+	rateCounter   *ratecounter.RateCounter
 	term          chan bool
 }
 
@@ -198,9 +278,12 @@ func (s3Writer *S3Writer) ValidateConfig(config *Config) error {
 	}
 
 	// Try writing to local path
-	if _, err := ioutil.TempFile(config.LocalPath, "logzoom"); err != nil {
+	probe, err := ioutil.TempFile(config.LocalPath, "logzoom")
+	if err != nil {
 		return errors.New("unable to write to " + config.LocalPath)
 	}
+	probe.Close()
+	os.Remove(probe.Name())
 
 	if len(config.AwsS3Bucket) == 0 {
 		return errors.New("missing AWS S3 bucket")
@@ -214,6 +297,18 @@ func (s3Writer *S3Writer) ValidateConfig(config *Config) error {
 		return errors.New("missing AWS S3 output key")
 	}
 
+	if hasFieldReferences(config.FallbackOutputKey) {
+		return errors.New("fallback output key can't refer to event fields")
+	}
+
+	if s3Writer.Config.MaxOpenFiles <= 0 {
+		s3Writer.Config.MaxOpenFiles = defaultMaxOpenFiles
+	}
+
+	if s3Writer.Config.MaxAge <= 0 {
+		s3Writer.Config.MaxAge = s3FlushInterval
+	}
+
 	if s3Writer.Config.SampleSize == nil {
 		i := 100
 		s3Writer.Config.SampleSize = &i
@@ -235,7 +330,6 @@ func (s3Writer *S3Writer) Init(name string, config yaml.MapSlice, sender buffer.
 	}
 
 	s3Writer.name = name
-	s3Writer.fields = route.Fields
 	s3Writer.uploadChannel = make(chan OutputFileInfo, maxSimultaneousUploads)
 	s3Writer.Config = *s3Config
 	s3Writer.Sender = sender
@@ -278,40 +372,67 @@ func (s3Writer *S3Writer) Start() error {
 		log.Printf("[%s] No route is specified for this output", s3Writer.name)
 		return nil
 	}
-	// Create file saver
-	fileSaver := new(FileSaver)
-	fileSaver.Config = s3Writer.Config
-	fileSaver.RateCounter = ratecounter.NewRateCounter(1 * time.Second)
+	// One file saver per partition
+	savers := make(map[string]*FileSaver)
+	s3Writer.rateCounter = ratecounter.NewRateCounter(1 * time.Second)
 
-	id := "s3_output"
 	// Add the client as a subscriber
 	receiveChan := make(chan *buffer.Event, recvBuffer)
-	s3Writer.Sender.AddSubscriber(id, receiveChan)
-	defer s3Writer.Sender.DelSubscriber(id)
+	s3Writer.Sender.AddSubscriber(s3Writer.name, receiveChan)
+	defer s3Writer.Sender.DelSubscriber(s3Writer.name)
 
 	// Loop events and publish to S3
-	tick := time.NewTicker(time.Duration(s3FlushInterval) * time.Second)
+	tick := time.NewTicker(time.Duration(rotateCheckInterval) * time.Second)
+
+	for i := 0; i < maxSimultaneousUploads; i++ {
+		go s3Writer.WaitForUpload()
+	}
 
-	go s3Writer.WaitForUpload()
+	// Upload what a previous run left behind
+	s3Writer.RecoverLocalFiles()
 
 	for {
 		select {
 		case ev := <-receiveChan:
-			var allowed bool
-			allowed = true
-			for key, value :=  range s3Writer.fields {
-				if ((*ev.Fields)[key] == nil || ((*ev.Fields)[key] != nil && value != (*ev.Fields)[key].(string))) {
-					allowed = false
-					break
-				}
+			if server.RandInt(0, 100) > *s3Writer.Config.SampleSize {
+				continue
 			}
-			if allowed && server.RandInt(0, 100) <= *s3Writer.Config.SampleSize {
-				fileSaver.WriteToFile(s3Writer.name, ev)
+
+			key, err := s3Writer.partition(ev)
+			if err != nil {
+				log.Printf("[%s] Dropping event: %v", s3Writer.name, err)
+				continue
+			}
+
+			fileSaver := s3Writer.fileSaver(savers, key)
+			if err := fileSaver.WriteToFile(s3Writer.name, ev); err != nil {
+				// A gzip writer can't be used after an error: upload
+				// what was written and start a new file
+				log.Printf("[%s] Dropping event: %v", s3Writer.name, err)
+				s3Writer.InitiateUploadToS3(fileSaver)
+				delete(savers, key)
+				continue
+			}
+
+			if fileSaver.Full() {
+				s3Writer.InitiateUploadToS3(fileSaver)
+				delete(savers, key)
 			}
 		case <-tick.C:
-			s3Writer.InitiateUploadToS3(fileSaver)
+			for key, fileSaver := range savers {
+				if fileSaver.Expired() {
+					s3Writer.InitiateUploadToS3(fileSaver)
+					delete(savers, key)
+				}
+			}
 		case <-s3Writer.term:
 			log.Println("S3Writer received term signal")
+			// The finished files are uploaded on the next start
+			for _, fileSaver := range savers {
+				if fileSaver.Writer != nil {
+					fileSaver.Close()
+				}
+			}
 			return nil
 		}
 	}
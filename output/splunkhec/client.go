@@ -0,0 +1,242 @@
+package splunkhec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/packetzoom/logzoom/buffer"
+)
+
+type hecEvent struct {
+	Time       float64                `json:"time,omitempty"`
+	Host       string                 `json:"host,omitempty"`
+	Source     string                 `json:"source,omitempty"`
+	Sourcetype string                 `json:"sourcetype,omitempty"`
+	Index      string                 `json:"index,omitempty"`
+	Event      interface{}            `json:"event"`
+	Fields     map[string]interface{} `json:"fields,omitempty"`
+}
+
+type hecResponse struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckID *int64 `json:"ackId"`
+}
+
+// retryableError marks failures worth sending again
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+// expand resolves a metadata template, leaving it unset when the event
+// lacks a referenced field so Splunk applies the token defaults
+func expand(ev *buffer.Event, template string) string {
+	if len(template) == 0 {
+		return ""
+	}
+
+	value, err := ev.Expand(template)
+	if err != nil {
+		return ""
+	}
+	return value
+}
+
+func (h *HECServer) timestamp(ev *buffer.Event) float64 {
+	if value, ok := ev.FieldString(h.config.TimestampField); ok {
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return float64(t.UnixNano()) / 1e9
+		}
+	}
+
+	return float64(time.Now().UnixNano()) / 1e9
+}
+
+func (h *HECServer) toHECEvent(ev *buffer.Event) *hecEvent {
+	e := &hecEvent{
+		Time:       h.timestamp(ev),
+		Host:       expand(ev, h.config.Host),
+		Source:     expand(ev, h.config.Source),
+		Sourcetype: expand(ev, h.config.Sourcetype),
+		Index:      expand(ev, h.config.Index),
+		Event:      *ev.Text,
+	}
+
+	if h.config.Format == "json" && ev.Fields != nil {
+		e.Event = ev.Fields
+	}
+
+	for _, field := range h.config.IndexedFields {
+		if value, ok := ev.FieldString(field); ok {
+			if e.Fields == nil {
+				e.Fields = make(map[string]interface{})
+			}
+			e.Fields[field] = value
+		}
+	}
+
+	return e
+}
+
+// encodeBatch concatenates the events as the event endpoint expects
+func (h *HECServer) encodeBatch(events []*buffer.Event) ([]byte, error) {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+
+	for _, ev := range events {
+		if err := encoder.Encode(h.toHECEvent(ev)); err != nil {
+			return nil, err
+		}
+	}
+
+	return body.Bytes(), nil
+}
+
+func (h *HECServer) newRequest(path string, body []byte) (*http.Request, error) {
+	var reader io.Reader = bytes.NewReader(body)
+
+	if h.config.Gzip {
+		var compressed bytes.Buffer
+		w := gzip.NewWriter(&compressed)
+		w.Write(body)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		reader = &compressed
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimSuffix(h.config.URL, "/")+path, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Splunk "+h.config.Token)
+	req.Header.Set("Content-Type", "application/json")
+	if h.config.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if len(h.channel) > 0 {
+		req.Header.Set("X-Splunk-Request-Channel", h.channel)
+	}
+
+	return req, nil
+}
+
+// do posts to a HEC endpoint and decodes the response into v
+func (h *HECServer) do(path string, body []byte, v interface{}) error {
+	req, err := h.newRequest(path, body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return &retryableError{err}
+	}
+	defer resp.Body.Close()
+
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if v != nil {
+			return json.Unmarshal(data, v)
+		}
+		return nil
+	}
+
+	err = fmt.Errorf("server returned %s: %s", resp.Status, bytes.TrimSpace(data))
+
+	// 503 is also returned when the indexer queues are full
+	if resp.StatusCode == 429 || resp.StatusCode >= 500 {
+		return &retryableError{err}
+	}
+
+	return err
+}
+
+// waitForAck polls the ack endpoint until Splunk reports the batch as
+// indexed, or the ack timeout expires
+func (h *HECServer) waitForAck(id int64) error {
+	body := []byte(fmt.Sprintf(`{"acks":[%d]}`, id))
+	deadline := time.Now().Add(time.Duration(h.config.AckTimeout) * time.Second)
+
+	for time.Now().Before(deadline) {
+		time.Sleep(ackPollInterval)
+
+		var status struct {
+			Acks map[string]bool `json:"acks"`
+		}
+
+		if err := h.do("/services/collector/ack", body, &status); err != nil {
+			log.Printf("[%s] Error polling ack %d: %v", h.name, id, err)
+			continue
+		}
+
+		if status.Acks[strconv.FormatInt(id, 10)] {
+			return nil
+		}
+	}
+
+	return &retryableError{fmt.Errorf("ack %d not received within %ds", id, h.config.AckTimeout)}
+}
+
+func (h *HECServer) sendOnce(body []byte) error {
+	var resp hecResponse
+	if err := h.do("/services/collector/event", body, &resp); err != nil {
+		return err
+	}
+
+	if !h.config.UseAck {
+		return nil
+	}
+
+	if resp.AckID == nil {
+		return errors.New("indexer acknowledgement is not enabled for this token")
+	}
+
+	return h.waitForAck(*resp.AckID)
+}
+
+// send posts a batch, retrying network errors, 429 and 5xx responses, and
+// batches that were not acknowledged in time
+func (h *HECServer) send(events []*buffer.Event) {
+	body, err := h.encodeBatch(events)
+	if err != nil {
+		log.Printf("[%s] Error encoding %d events: %v", h.name, len(events), err)
+		return
+	}
+
+	backoff := time.Second
+
+	for attempt := 0; ; attempt++ {
+		err = h.sendOnce(body)
+		if err == nil {
+			return
+		}
+
+		if _, ok := err.(*retryableError); !ok || attempt >= *h.config.MaxRetries {
+			log.Printf("[%s] Dropping %d events: %v", h.name, len(events), err)
+			return
+		}
+
+		log.Printf("[%s] Error sending to Splunk: %v, retrying in %s", h.name, err, backoff)
+		time.Sleep(backoff)
+		if backoff < maxRetryBackoff {
+			backoff *= 2
+		}
+	}
+}
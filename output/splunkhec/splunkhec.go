@@ -0,0 +1,261 @@
+package splunkhec
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/packetzoom/logzoom/buffer"
+	"github.com/packetzoom/logzoom/output"
+	"github.com/packetzoom/logzoom/route"
+	"github.com/packetzoom/logzoom/server"
+	"github.com/paulbellamy/ratecounter"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	recvBuffer            = 10000
+	rateDisplayInterval   = 10
+	defaultBatchSize      = 100
+	defaultFlushInterval  = 1
+	defaultTimeout        = 30
+	defaultMaxRetries     = 3
+	defaultWorkers        = 1
+	defaultAckTimeout     = 60
+	defaultTimestampField = "timestamp"
+	ackPollInterval       = time.Second
+	maxRetryBackoff       = 60 * time.Second
+)
+
+type Config struct {
+	URL                   string   `yaml:"url"`
+	Token                 string   `yaml:"token"`
+	Index                 string   `yaml:"index"`
+	Sourcetype            string   `yaml:"sourcetype"`
+	Source                string   `yaml:"source"`
+	Host                  string   `yaml:"host"`
+	IndexedFields         []string `yaml:"indexed_fields"`
+	TimestampField        string   `yaml:"timestamp_field"`
+	Format                string   `yaml:"format"`
+	Gzip                  bool     `yaml:"gzip"`
+	UseAck                bool     `yaml:"use_ack"`
+	AckTimeout            int      `yaml:"ack_timeout"`
+	Channel               string   `yaml:"channel"`
+	BatchSize             int      `yaml:"batch_size"`
+	FlushInterval         int      `yaml:"flush_interval"`
+	Timeout               int      `yaml:"timeout"`
+	MaxRetries            *int     `yaml:"max_retries,omitempty"`
+	Workers               int      `yaml:"workers"`
+	SSLCA                 string   `yaml:"ssl_ca"`
+	SSLInsecureSkipVerify bool     `yaml:"ssl_insecure_skip_verify"`
+	SampleSize            *int     `yaml:"sample_size,omitempty"`
+}
+
+type HECServer struct {
+	name    string
+	config  Config
+	sender  buffer.Sender
+	client  *http.Client
+	channel string
+	batches chan []*buffer.Event
+	term    chan bool
+}
+
+func init() {
+	output.Register("splunk_hec", New)
+}
+
+func New() output.Output {
+	return &HECServer{term: make(chan bool, 1)}
+}
+
+// newChannel returns a random GUID for the request channel, which Splunk
+// requires when indexer acknowledgement is enabled
+func newChannel() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func (h *HECServer) ValidateConfig(config *Config) error {
+	if len(config.URL) == 0 {
+		return errors.New("Missing url")
+	}
+
+	if len(config.Token) == 0 {
+		return errors.New("Missing token")
+	}
+
+	switch h.config.Format {
+	case "":
+		h.config.Format = "text"
+	case "text", "json":
+	default:
+		return fmt.Errorf("Unknown format %s (must be text or json)", config.Format)
+	}
+
+	if len(h.config.TimestampField) == 0 {
+		h.config.TimestampField = defaultTimestampField
+	}
+
+	if h.config.AckTimeout <= 0 {
+		h.config.AckTimeout = defaultAckTimeout
+	}
+
+	if h.config.BatchSize <= 0 {
+		h.config.BatchSize = defaultBatchSize
+	}
+
+	if h.config.FlushInterval <= 0 {
+		h.config.FlushInterval = defaultFlushInterval
+	}
+
+	if h.config.Timeout <= 0 {
+		h.config.Timeout = defaultTimeout
+	}
+
+	if h.config.MaxRetries == nil {
+		i := defaultMaxRetries
+		h.config.MaxRetries = &i
+	}
+
+	if h.config.Workers <= 0 {
+		h.config.Workers = defaultWorkers
+	}
+
+	if h.config.SampleSize == nil {
+		i := 100
+		h.config.SampleSize = &i
+	}
+	log.Printf("[%s] Setting Sample Size to %d", h.name, *h.config.SampleSize)
+
+	return nil
+}
+
+func (h *HECServer) Init(name string, config yaml.MapSlice, sender buffer.Sender, route route.Route) error {
+	var hecConfig *Config
+
+	// go-yaml doesn't have a great way to partially unmarshal YAML data
+	// See https://github.com/go-yaml/yaml/issues/13
+	yamlConfig, _ := yaml.Marshal(config)
+
+	if err := yaml.Unmarshal(yamlConfig, &hecConfig); err != nil {
+		return fmt.Errorf("Error parsing Splunk HEC config: %v", err)
+	}
+
+	h.name = name
+	h.config = *hecConfig
+	h.sender = sender
+
+	if err := h.ValidateConfig(hecConfig); err != nil {
+		return fmt.Errorf("Error in config: %v", err)
+	}
+
+	h.channel = h.config.Channel
+	if h.config.UseAck && len(h.channel) == 0 {
+		channel, err := newChannel()
+		if err != nil {
+			return err
+		}
+		h.channel = channel
+	}
+
+	return nil
+}
+
+func (h *HECServer) tlsConfig() (*tls.Config, error) {
+	return server.ClientTLSConfig(h.config.SSLCA, "", "", h.config.SSLInsecureSkipVerify)
+}
+
+func (h *HECServer) worker() {
+	for events := range h.batches {
+		h.send(events)
+	}
+}
+
+func (h *HECServer) Start() error {
+	if h.sender == nil {
+		log.Printf("[%s] No route is specified for this output", h.name)
+		return nil
+	}
+
+	tlsConfig, err := h.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	h.client = &http.Client{
+		Timeout: time.Duration(h.config.Timeout) * time.Second,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConnsPerHost: h.config.Workers,
+		},
+	}
+
+	h.batches = make(chan []*buffer.Event, h.config.Workers)
+	for i := 0; i < h.config.Workers; i++ {
+		go h.worker()
+	}
+
+	// Add the client as a subscriber
+	receiveChan := make(chan *buffer.Event, recvBuffer)
+	h.sender.AddSubscriber(h.name, receiveChan)
+	defer h.sender.DelSubscriber(h.name)
+
+	flushTick := time.NewTicker(time.Duration(h.config.FlushInterval) * time.Second)
+	defer flushTick.Stop()
+	tick := time.NewTicker(time.Duration(rateDisplayInterval) * time.Second)
+	defer tick.Stop()
+	rateCounter := ratecounter.NewRateCounter(1 * time.Second)
+
+	events := make([]*buffer.Event, 0, h.config.BatchSize)
+
+	log.Printf("[%s] Started Splunk HEC Output Instance", h.name)
+
+	for {
+		select {
+		case ev := <-receiveChan:
+			if server.RandInt(0, 100) >= *h.config.SampleSize {
+				continue
+			}
+			rateCounter.Incr(1)
+			events = append(events, ev)
+			if len(events) >= h.config.BatchSize {
+				h.batches <- events
+				events = make([]*buffer.Event, 0, h.config.BatchSize)
+			}
+		case <-flushTick.C:
+			if len(events) > 0 {
+				h.batches <- events
+				events = make([]*buffer.Event, 0, h.config.BatchSize)
+			}
+		case <-tick.C:
+			if rateCounter.Rate() > 0 {
+				log.Printf("[%s] Current Splunk HEC output rate: %d/s\n", h.name, rateCounter.Rate())
+			}
+		case <-h.term:
+			log.Println("Splunk HEC output received term signal")
+			if len(events) > 0 {
+				h.batches <- events
+			}
+			close(h.batches)
+			return nil
+		}
+	}
+}
+
+func (h *HECServer) Stop() error {
+	h.term <- true
+	return nil
+}
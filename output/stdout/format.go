@@ -0,0 +1,142 @@
+package stdout
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/packetzoom/logzoom/buffer"
+)
+
+const (
+	colorReset  = "\x1b[0m"
+	colorRed    = "\x1b[31m"
+	colorYellow = "\x1b[33m"
+	colorCyan   = "\x1b[36m"
+	colorGray   = "\x1b[90m"
+)
+
+// levelColor picks a colour from the level field of an event, so errors
+// and warnings stand out
+func levelColor(ev *buffer.Event) string {
+	level, ok := ev.FieldString("level")
+	if !ok {
+		return ""
+	}
+
+	switch strings.ToLower(level) {
+	case "fatal", "panic", "crit", "critical", "alert", "emerg", "err", "error":
+		return colorRed
+	case "warn", "warning":
+		return colorYellow
+	case "debug", "trace":
+		return colorGray
+	}
+
+	return ""
+}
+
+func (s *StdoutServer) formatJSON(ev *buffer.Event) ([]byte, error) {
+	doc := map[string]interface{}{
+		"source": ev.Source,
+		"text":   ev.Text,
+		"fields": ev.Fields,
+	}
+
+	if s.config.Pretty {
+		return json.MarshalIndent(doc, "", "  ")
+	}
+
+	return json.Marshal(doc)
+}
+
+// logfmtValue quotes values containing spaces, quotes or equals signs
+func logfmtValue(value interface{}) string {
+	var str string
+
+	switch v := value.(type) {
+	case string:
+		str = v
+	case nil:
+		return ""
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(v)
+		str = string(b)
+	default:
+		str = fmt.Sprint(v)
+	}
+
+	if len(str) == 0 || strings.ContainsAny(str, " \t\n\"=") {
+		return fmt.Sprintf("%q", str)
+	}
+
+	return str
+}
+
+func (s *StdoutServer) formatLogfmt(ev *buffer.Event) []byte {
+	var line bytes.Buffer
+
+	pair := func(key string, value interface{}) {
+		if line.Len() > 0 {
+			line.WriteByte(' ')
+		}
+		if s.config.Color {
+			line.WriteString(colorCyan + key + colorReset)
+		} else {
+			line.WriteString(key)
+		}
+		line.WriteByte('=')
+		line.WriteString(logfmtValue(value))
+	}
+
+	pair("source", ev.Source)
+
+	if ev.Fields != nil {
+		keys := make([]string, 0, len(*ev.Fields))
+		for key := range *ev.Fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			pair(key, (*ev.Fields)[key])
+		}
+	}
+
+	if ev.Text != nil {
+		pair("text", *ev.Text)
+	}
+
+	return line.Bytes()
+}
+
+// format renders an event as a single entry, without the trailing newline
+func (s *StdoutServer) format(ev *buffer.Event) ([]byte, error) {
+	var line []byte
+	var err error
+
+	switch s.config.Format {
+	case formatJSON:
+		line, err = s.formatJSON(ev)
+	case formatLogfmt:
+		line = s.formatLogfmt(ev)
+	default:
+		if ev.Text != nil {
+			line = []byte(*ev.Text)
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if s.config.Color && s.config.Format != formatLogfmt {
+		if color := levelColor(ev); len(color) > 0 {
+			line = []byte(color + string(line) + colorReset)
+		}
+	}
+
+	return line, nil
+}
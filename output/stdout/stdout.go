@@ -0,0 +1,150 @@
+package stdout
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/packetzoom/logzoom/buffer"
+	"github.com/packetzoom/logzoom/output"
+	"github.com/packetzoom/logzoom/route"
+	"github.com/packetzoom/logzoom/server"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	recvBuffer    = 10000
+	flushInterval = 100 * time.Millisecond
+
+	formatText   = "text"
+	formatJSON   = "json"
+	formatLogfmt = "logfmt"
+)
+
+type Config struct {
+	Stream     string `yaml:"stream"`
+	Format     string `yaml:"format"`
+	Pretty     bool   `yaml:"pretty"`
+	Color      bool   `yaml:"color"`
+	SampleSize *int   `yaml:"sample_size,omitempty"`
+}
+
+type StdoutServer struct {
+	name   string
+	config Config
+	sender buffer.Sender
+	term   chan bool
+}
+
+func init() {
+	output.Register("stdout", New)
+}
+
+func New() output.Output {
+	return &StdoutServer{term: make(chan bool, 1)}
+}
+
+func (s *StdoutServer) ValidateConfig(config *Config) error {
+	switch s.config.Stream {
+	case "":
+		s.config.Stream = "stdout"
+	case "stdout", "stderr":
+	default:
+		return errors.New("Unknown stream (must be stdout or stderr)")
+	}
+
+	switch s.config.Format {
+	case "":
+		s.config.Format = formatText
+	case formatText, formatJSON, formatLogfmt:
+	default:
+		return fmt.Errorf("Unknown format %s (must be text, json or logfmt)", config.Format)
+	}
+
+	if s.config.SampleSize == nil {
+		i := 100
+		s.config.SampleSize = &i
+	}
+	log.Printf("[%s] Setting Sample Size to %d", s.name, *s.config.SampleSize)
+
+	return nil
+}
+
+func (s *StdoutServer) Init(name string, config yaml.MapSlice, sender buffer.Sender, route route.Route) error {
+	var stdoutConfig *Config
+
+	// go-yaml doesn't have a great way to partially unmarshal YAML data
+	// See https://github.com/go-yaml/yaml/issues/13
+	yamlConfig, _ := yaml.Marshal(config)
+
+	if err := yaml.Unmarshal(yamlConfig, &stdoutConfig); err != nil {
+		return fmt.Errorf("Error parsing stdout config: %v", err)
+	}
+
+	s.name = name
+	s.config = *stdoutConfig
+	s.sender = sender
+
+	if err := s.ValidateConfig(stdoutConfig); err != nil {
+		return fmt.Errorf("Error in config: %v", err)
+	}
+
+	return nil
+}
+
+func (s *StdoutServer) Start() error {
+	if s.sender == nil {
+		log.Printf("[%s] No route is specified for this output", s.name)
+		return nil
+	}
+
+	var stream io.Writer = os.Stdout
+	if s.config.Stream == "stderr" {
+		stream = os.Stderr
+	}
+
+	// Writes are buffered and flushed shortly after, so bursts don't cost a
+	// system call per event
+	writer := bufio.NewWriter(stream)
+	defer writer.Flush()
+
+	// Add the client as a subscriber
+	receiveChan := make(chan *buffer.Event, recvBuffer)
+	s.sender.AddSubscriber(s.name, receiveChan)
+	defer s.sender.DelSubscriber(s.name)
+
+	tick := time.NewTicker(flushInterval)
+	defer tick.Stop()
+
+	log.Printf("[%s] Started Stdout Output Instance", s.name)
+
+	for {
+		select {
+		case ev := <-receiveChan:
+			if server.RandInt(0, 100) >= *s.config.SampleSize {
+				continue
+			}
+			line, err := s.format(ev)
+			if err != nil {
+				log.Printf("[%s] Error formatting event: %v", s.name, err)
+				continue
+			}
+			writer.Write(line)
+			writer.WriteByte('\n')
+		case <-tick.C:
+			writer.Flush()
+		case <-s.term:
+			log.Println("Stdout output received term signal")
+			return nil
+		}
+	}
+}
+
+func (s *StdoutServer) Stop() error {
+	s.term <- true
+	return nil
+}
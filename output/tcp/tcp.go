@@ -23,7 +23,6 @@ type Config struct {
 
 type TCPServer struct {
 	name string
-	fields map[string]string
 	b    buffer.Sender
 	term chan bool
 	config *Config
@@ -54,15 +53,7 @@ func (s *TCPServer) accept(c net.Conn) {
 	for {
 		select {
 		case ev := <-r:
-			var allowed bool
-			allowed = true
-			for key, value :=  range s.fields {
-				if ((*ev.Fields)[key] == nil || ((*ev.Fields)[key] != nil && value != (*ev.Fields)[key].(string))) {
-					allowed = false
-					break
-				}
-                        }
-                        if allowed && server.RandInt(0, 100) < *s.config.SampleSize {
+                        if server.RandInt(0, 100) < *s.config.SampleSize {
 				_, err := c.Write([]byte(fmt.Sprintf("%s %s\n", ev.Source, *ev.Text)))
 				if err != nil {
 					log.Printf("[%s - %s] error sending event to tcp connection: %v", s.name, c.RemoteAddr().String(), err)
@@ -86,7 +77,6 @@ func (s *TCPServer) Init(name string, config yaml.MapSlice, b buffer.Sender, rou
 	}
 
 	s.name = name
-	s.fields = route.Fields
 	s.config = tcpConfig
 	s.b = b
 	return nil
@@ -28,7 +28,6 @@ type Config struct {
 
 type WebSocketServer struct {
 	name string
-	fields map[string]string
 	b    buffer.Sender
 	term chan bool
 	config *Config
@@ -149,7 +148,6 @@ func (ws *WebSocketServer) Init(name string, config yaml.MapSlice, b buffer.Send
 	}
 
 	ws.name = name
-	ws.fields = route.Fields
 	ws.config = wsConfig
 	ws.b = b
 	return nil
@@ -0,0 +1,119 @@
+// Package redisconn holds the connection settings shared by the Redis input
+// and output, and connects to a single server, a Redis Cluster or the
+// master reported by Sentinel.
+package redisconn
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strconv"
+
+	goredis "github.com/go-redis/redis"
+	"github.com/packetzoom/logzoom/server"
+)
+
+// Config is embedded inline in the input and output configurations
+type Config struct {
+	Host                  string   `yaml:"host"`
+	Port                  int      `yaml:"port"`
+	Db                    int64    `yaml:"db"`
+	Password              string   `yaml:"password"`
+	SentinelMaster        string   `yaml:"sentinel_master"`
+	SentinelAddrs         []string `yaml:"sentinel_addrs"`
+	ClusterAddrs          []string `yaml:"cluster_addrs"`
+	TLS                   bool     `yaml:"tls"`
+	SSLCA                 string   `yaml:"ssl_ca"`
+	SSLCrt                string   `yaml:"ssl_crt"`
+	SSLKey                string   `yaml:"ssl_key"`
+	SSLInsecureSkipVerify bool     `yaml:"ssl_insecure_skip_verify"`
+}
+
+// Validate checks that a server, a cluster or a sentinel setup is given
+func (config *Config) Validate() error {
+	if len(config.SentinelMaster) > 0 {
+		if len(config.SentinelAddrs) == 0 {
+			return errors.New("Missing Redis sentinel addresses")
+		}
+	} else if len(config.ClusterAddrs) == 0 {
+		if len(config.Host) == 0 {
+			return errors.New("Missing Redis host")
+		}
+
+		if config.Port <= 0 {
+			return errors.New("Missing Redis port")
+		}
+	}
+
+	return nil
+}
+
+func tlsConfig(config Config) (*tls.Config, error) {
+	if !config.TLS {
+		return nil, nil
+	}
+
+	return server.ClientTLSConfig(config.SSLCA, config.SSLCrt, config.SSLKey, config.SSLInsecureSkipVerify)
+}
+
+// NewClient connects to a single server, a Redis Cluster, or the master
+// reported by Sentinel. The cluster and failover clients follow topology
+// changes and reconnect after a failover by themselves.
+func NewClient(config Config) (goredis.UniversalClient, error) {
+	tlsConfig, err := tlsConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.ClusterAddrs) > 0 {
+		return goredis.NewClusterClient(&goredis.ClusterOptions{
+			Addrs:     config.ClusterAddrs,
+			Password:  config.Password,
+			TLSConfig: tlsConfig,
+		}), nil
+	}
+
+	if len(config.SentinelMaster) > 0 {
+		return goredis.NewFailoverClient(&goredis.FailoverOptions{
+			MasterName:    config.SentinelMaster,
+			SentinelAddrs: config.SentinelAddrs,
+			Password:      config.Password,
+			DB:            int(config.Db),
+			TLSConfig:     tlsConfig,
+		}), nil
+	}
+
+	return goredis.NewClient(&goredis.Options{
+		Addr:      fmt.Sprintf("%s:%d", config.Host, config.Port),
+		Password:  config.Password,
+		DB:        int(config.Db),
+		TLSConfig: tlsConfig,
+	}), nil
+}
+
+// MasterAddr returns the host and port of the redismq server, asking the
+// sentinels for the current master when Sentinel is configured
+func MasterAddr(config Config) (string, int, error) {
+	if len(config.SentinelMaster) == 0 {
+		return config.Host, config.Port, nil
+	}
+
+	err := errors.New("no sentinel available")
+
+	for _, addr := range config.SentinelAddrs {
+		sentinel := goredis.NewSentinelClient(&goredis.Options{Addr: addr})
+		var master []string
+		master, err = sentinel.GetMasterAddrByName(config.SentinelMaster).Result()
+		sentinel.Close()
+
+		if err == nil && len(master) == 2 {
+			port, err := strconv.Atoi(master[1])
+			if err != nil {
+				return "", 0, err
+			}
+			return master[0], port, nil
+		}
+	}
+
+	return "", 0, fmt.Errorf("Could not find master %s: %v", config.SentinelMaster, err)
+}
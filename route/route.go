@@ -1,7 +1,32 @@
 package route
 
+import (
+	"github.com/packetzoom/logzoom/buffer"
+)
+
 type Route struct {
 	Input	string
 	Output	string
 	Fields	map[string]string
 }
+
+// Match reports whether an event has every field of the route rules with
+// the given value. A route without rules matches every event.
+func (r Route) Match(ev *buffer.Event) bool {
+	if len(r.Fields) == 0 {
+		return true
+	}
+
+	if ev.Fields == nil {
+		return false
+	}
+
+	for key, value := range r.Fields {
+		field, ok := (*ev.Fields)[key].(string)
+		if !ok || field != value {
+			return false
+		}
+	}
+
+	return true
+}
@@ -72,8 +72,11 @@ func (s *Server) Start() {
 				}
 			}
 			if (&input != nil && &output != nil) {
-				s.buffers[input] = buffer.New()
-				go s.buffers[input].Start()
+				// Routes sharing an input share its buffer
+				if _, ok := s.buffers[input]; !ok {
+					s.buffers[input] = buffer.New()
+					go s.buffers[input].Start()
+				}
 				route := route.Route{Input: input, Output: output, Fields: rules}
 				s.routes[name] = route
 			}
@@ -123,7 +126,9 @@ func (s *Server) Start() {
 					init := false
 					for route_name, value := range s.routes {
 						if value.Output == name {
-							err = out.Init(name, item.Value.(yaml.MapSlice), s.buffers[value.Input], s.routes[route_name]);
+							// The output only receives events matching the route rules
+							sender := s.buffers[value.Input].Filter(value.Match)
+							err = out.Init(name, item.Value.(yaml.MapSlice), sender, s.routes[route_name]);
 							if err != nil {
 								log.Fatalf("Failed to init %s input: %v", item.Key, err)
 							}
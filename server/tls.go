@@ -0,0 +1,36 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// ClientTLSConfig returns the TLS configuration used by outputs to connect
+// to a server. The CA bundle replaces the system roots when set, and the
+// certificate and key are only loaded when a certificate is given.
+func ClientTLSConfig(ca, crt, key string, insecureSkipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: insecureSkipVerify}
+
+	if len(ca) > 0 {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading CA bundle: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA bundle %s", ca)
+		}
+	}
+
+	if len(crt) > 0 {
+		cert, err := tls.LoadX509KeyPair(crt, key)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading keys: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}